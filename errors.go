@@ -0,0 +1,183 @@
+package jee
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CompileError is the error returned when a query cannot be lexed, parsed or
+// compiled.
+type CompileError struct {
+	Pos Position
+	Msg string
+	// Query is the query being compiled, if known. It is used to show where
+	// the error is.
+	Query string
+}
+
+func (e *CompileError) Error() string {
+	return locate(e.Msg, e.Query, e.Pos)
+}
+
+// ErrorKind classifies an EvalError.
+type ErrorKind int
+
+const (
+	// TypeError means a value had the wrong type for an operator, key,
+	// condition or function argument.
+	TypeError ErrorKind = iota + 1
+	// UndefinedError means a variable or function does not exist.
+	UndefinedError
+	// ArityError means a function was called with the wrong number of
+	// arguments.
+	ArityError
+	// FuncError means a function returned an error of its own.
+	FuncError
+	// PanicError means evaluation panicked. It always indicates a bug in jee
+	// or in a registered function.
+	PanicError
+)
+
+var errorKindNames = map[ErrorKind]string{
+	TypeError:      "type error",
+	UndefinedError: "undefined",
+	ArityError:     "wrong num of arguments",
+	FuncError:      "func error",
+	PanicError:     "panic",
+}
+
+func (k ErrorKind) String() string {
+	return errorKindNames[k]
+}
+
+// EvalError is the error returned when an expression cannot be evaluated.
+type EvalError struct {
+	Kind ErrorKind
+	// Func is the function being called when the error occurred, if any.
+	Func string
+	// Type is the type of the offending value of a TypeError.
+	Type Type
+	// Pos is where the operator, key or call that failed is in the query.
+	// It is not valid if the location is not known.
+	Pos Position
+	Msg string
+	// Err is the error returned by Func, for a FuncError.
+	Err error
+	// Query is the query being evaluated, if known. It is used to show where
+	// the error is.
+	Query string
+}
+
+func (e *EvalError) Error() string {
+	msg := e.Msg
+	if e.Func != "" {
+		msg = e.Func + ": " + msg
+	}
+	return locate(msg, e.Query, e.Pos)
+}
+
+// Unwrap returns the error returned by Func, if any.
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// evalError returns an EvalError for the node t.
+func evalError(t *TokenTree, kind ErrorKind, format string, args ...interface{}) *EvalError {
+	return &EvalError{
+		Kind: kind,
+		Pos:  t.Pos,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// typeError returns a TypeError for the node t about the value v.
+func typeError(t *TokenTree, v interface{}, format string, args ...interface{}) *EvalError {
+	e := evalError(t, TypeError, format, args...)
+	e.Type = typeOf(v)
+	return e
+}
+
+// argError returns a TypeError for a function to return about one of its
+// arguments. The function name and position are filled in by callFunc.
+func argError(v interface{}, format string, args ...interface{}) *EvalError {
+	return &EvalError{
+		Kind: TypeError,
+		Type: typeOf(v),
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// recoverEval turns a panic during evaluation into a PanicError. It must be
+// deferred directly.
+func recoverEval(err *error) {
+	if r := recover(); r != nil {
+		*err = &EvalError{
+			Kind: PanicError,
+			Msg:  fmt.Sprint(r),
+		}
+	}
+}
+
+// withQuery returns a copy of a CompileError or EvalError that shows where
+// in query it occurred.
+func withQuery(err error, query string) error {
+	switch e := err.(type) {
+	case *CompileError:
+		c := *e
+		c.Query = query
+		return &c
+	case *EvalError:
+		c := *e
+		c.Query = query
+		return &c
+	}
+	return err
+}
+
+// located returns err showing where in the query t was parsed from it
+// occurred. Only the root of a tree returned by Parser knows its query.
+func (t *TokenTree) located(err error) error {
+	if err == nil || t.query == "" {
+		return err
+	}
+	return withQuery(err, t.query)
+}
+
+// locate adds the position of an error to its message. If the query is
+// known, the line of the query the error is on follows, with a caret under
+// the position:
+//
+//	unexpected token: ) at line 1, col 6
+//	    .a + )
+//	         ^
+func locate(msg string, query string, pos Position) string {
+	if !pos.IsValid() {
+		return msg
+	}
+
+	msg = fmt.Sprintf("%s at %s", msg, pos)
+	if query == "" || pos.Offset > len(query) {
+		return msg
+	}
+
+	start := strings.LastIndex(query[:pos.Offset], "\n") + 1
+	end := strings.Index(query[pos.Offset:], "\n")
+	if end < 0 {
+		end = len(query)
+	} else {
+		end += pos.Offset
+	}
+	line := strings.TrimRight(query[start:end], "\r")
+
+	// keep tabs so that the caret lines up with the line above it
+	var pad strings.Builder
+	for _, r := range query[start:pos.Offset] {
+		if r == '\t' {
+			pad.WriteRune(r)
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+
+	return msg + "\n    " + line + "\n    " + pad.String() + "^"
+}
@@ -0,0 +1,343 @@
+package jee
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type ErrorTest struct {
+	exp  string
+	kind ErrorKind
+	fn   string
+	typ  Type
+	pos  int
+}
+
+var ErrorTests = []ErrorTest{
+	ErrorTest{exp: `.int + "a"`, kind: TypeError, typ: TypeString, pos: 5},
+	ErrorTest{exp: `-.string`, kind: TypeError, typ: TypeString, pos: 0},
+	ErrorTest{exp: `.nil < 1`, kind: TypeError, typ: TypeNull, pos: 5},
+	ErrorTest{exp: `.a.b.c[0].d.e["f"]`, kind: TypeError, typ: TypeNumber, pos: 13},
+	ErrorTest{exp: `.string[0]`, kind: TypeError, typ: TypeString, pos: 7},
+	ErrorTest{exp: `.arrayInt[.bool]`, kind: TypeError, typ: TypeBool, pos: 9},
+	ErrorTest{exp: `.arrayInt[? . * 2]`, kind: TypeError, typ: TypeNumber, pos: 14},
+	ErrorTest{exp: `true && (.int ? 1 : 2)`, kind: TypeError, typ: TypeNumber, pos: 14},
+	ErrorTest{exp: `{a: 1, (.int): 2}`, kind: TypeError, typ: TypeNumber, pos: 8},
+	ErrorTest{exp: `$sum(.arrayString)`, kind: TypeError, fn: "$sum", typ: TypeString, pos: 0},
+	ErrorTest{exp: `1 + $min([1, "a"])`, kind: TypeError, fn: "$min", typ: TypeString, pos: 4},
+	ErrorTest{exp: `$max([[1]])`, kind: TypeError, fn: "$max", typ: TypeArray, pos: 0},
+	ErrorTest{exp: `$clamp(.string, 0, 1)`, kind: TypeError, fn: "$clamp", typ: TypeString, pos: 7},
+	ErrorTest{exp: `$map(.arrayInt, . + "a")`, kind: TypeError, fn: "$map", typ: TypeString, pos: 18},
+	ErrorTest{exp: `$all(.arrayInt, $x -> $x)`, kind: TypeError, fn: "$all", typ: TypeNumber, pos: 22},
+	ErrorTest{exp: `$regex(.string, "(")`, kind: FuncError, fn: "$regex", pos: 0},
+	ErrorTest{exp: `$nope(1)`, kind: UndefinedError, pos: 0},
+	ErrorTest{exp: `@nope`, kind: UndefinedError, pos: 0},
+	ErrorTest{exp: `1 + $abs(1, 2)`, kind: ArityError, pos: 4},
+}
+
+func TestEvalErrorFields(t *testing.T) {
+	registerTestFuncs()
+
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+
+	for _, test := range ErrorTests {
+		tokenized, _ := Lexer(test.exp)
+		tree, err := Parser(tokenized)
+		if err != nil {
+			t.Error("failed parse", test.exp, err)
+			continue
+		}
+
+		_, err = Eval(tree, umsg)
+		ee, ok := err.(*EvalError)
+		if !ok {
+			t.Error(test.exp, "expected *EvalError, got", err)
+			continue
+		}
+
+		if ee.Kind != test.kind || ee.Func != test.fn || ee.Type != test.typ || ee.Pos.Offset != test.pos {
+			t.Errorf("%s: expected kind %q func %q type %q pos %d, got kind %q func %q type %q pos %d (%s)",
+				test.exp, test.kind, test.fn, test.typ, test.pos, ee.Kind, ee.Func, ee.Type, ee.Pos.Offset, ee)
+		}
+	}
+}
+
+func TestEvalErrorFuncError(t *testing.T) {
+	e := MustCompile(`$parseTime("2006", .string)`)
+	_, err := e.Eval(map[string]interface{}{"string": "not a year"})
+
+	var ee *EvalError
+	if !errors.As(err, &ee) || ee.Kind != FuncError || ee.Err == nil {
+		t.Fatal("expected a FuncError wrapping the error of $parseTime, got", err)
+	}
+	if errors.Unwrap(err) != ee.Err {
+		t.Error("Unwrap should return the error of $parseTime")
+	}
+	if !strings.HasPrefix(err.Error(), "$parseTime: ") {
+		t.Error("expected error to name $parseTime, got", err)
+	}
+}
+
+func TestEvalErrorPanic(t *testing.T) {
+	boom := &Func{
+		Fn: func(args []interface{}) (interface{}, error) {
+			var m map[string]interface{}
+			m["a"] = 1
+			return nil, nil
+		},
+	}
+
+	e := MustCompile(`1 + $boom()`, WithFunc("boom", boom))
+	_, err := e.Eval(nil)
+	ee, ok := err.(*EvalError)
+	if !ok || ee.Kind != PanicError || ee.Func != "$boom" || ee.Pos.Offset != 4 {
+		t.Fatal("expected a PanicError from $boom, got", err)
+	}
+}
+
+type PositionTest struct {
+	exp  string
+	line int
+	col  int
+}
+
+var CompileErrorTests = []PositionTest{
+	PositionTest{exp: `.a + )`, line: 1, col: 6},
+	PositionTest{exp: `(.a`, line: 1, col: 4},
+	PositionTest{exp: `.a + "b`, line: 1, col: 6},
+	PositionTest{exp: `.a # 1`, line: 1, col: 4},
+	PositionTest{exp: `{"é": 1, 2: 3}`, line: 1, col: 10},
+	PositionTest{exp: "if .a\nthen 1\nels 2 end", line: 3, col: 1},
+	PositionTest{exp: "[1,\n  2,\n  3", line: 3, col: 4},
+	PositionTest{exp: "let $x = 1 in\n\t$nope($x)", line: 2, col: 2},
+	PositionTest{exp: `$abs(1, 2)`, line: 1, col: 1},
+	PositionTest{exp: `$clamp(1, 2, "3")`, line: 1, col: 14},
+	PositionTest{exp: `[$x -> $x]`, line: 1, col: 5},
+}
+
+func TestCompileErrorPositions(t *testing.T) {
+	registerTestFuncs()
+
+	for _, test := range CompileErrorTests {
+		_, err := Compile(test.exp)
+		ce, ok := err.(*CompileError)
+		if !ok {
+			t.Error(test.exp, "expected *CompileError, got", err)
+			continue
+		}
+
+		if ce.Pos.Line != test.line || ce.Pos.Col != test.col {
+			t.Errorf("%q: expected line %d col %d, got %s (%s)", test.exp, test.line, test.col, ce.Pos, ce)
+		}
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	tokens, err := Lexer("$map(.a,\n\t'é' + .b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Position{
+		{0, 1, 1}, {4, 1, 5}, {5, 1, 6}, {7, 1, 8},
+		{10, 2, 2}, {15, 2, 6}, {17, 2, 8}, {19, 2, 10},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatal("expected", len(expected), "tokens, got", len(tokens))
+	}
+	for i, tok := range tokens {
+		if tok.Pos != expected[i] {
+			t.Errorf("token %d %s: expected %v, got %v", i, tok.Value, expected[i], tok.Pos)
+		}
+	}
+}
+
+func TestErrorSnippet(t *testing.T) {
+	_, err := Compile("let $x = 1 in\n\t$x + )")
+	expected := "unbalanced () or [] at line 2, col 7\n" +
+		"    \t$x + )\n" +
+		"    \t     ^"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%v", expected, err)
+	}
+
+	e := MustCompile(".a +\r\n  .b")
+	_, err = e.Eval(map[string]interface{}{"a": 1.0, "b": "x"})
+	expected = "cannot compare types: float64, string at line 1, col 4\n" +
+		"    .a +\n" +
+		"       ^"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%v", expected, err)
+	}
+
+	// trees built by Lexer and Parser know the query too
+	tokens, _ := Lexer(".a + .b")
+	tree, _ := Parser(tokens)
+	_, err = Eval(tree, map[string]interface{}{"a": 1.0, "b": "x"})
+	expected = "cannot compare types: float64, string at line 1, col 4\n" +
+		"    .a + .b\n" +
+		"       ^"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%v", expected, err)
+	}
+
+	tokens, _ = Lexer("[.a,\n .b")
+	_, err = Parser(tokens)
+	expected = "unbalanced () or [] at line 2, col 4\n" +
+		"     .b\n" +
+		"       ^"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%v", expected, err)
+	}
+
+	// a tree built by hand knows positions but not the query
+	_, err = Eval(&TokenTree{Tokens: tree.Tokens}, map[string]interface{}{"a": 1.0, "b": "x"})
+	expected = "cannot compare types: float64, string at line 1, col 4"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+// fuzzQueries calls every built-in function, operator and accessor with the
+// external variables @a and @b. Expression arguments are given as ., so that
+// they evaluate to the array element they are applied to.
+func fuzzQueries() []string {
+	queries := []string{
+		`@a + @b`, `@a - @b`, `@a * @b`, `@a / @b`,
+		`@a == @b`, `@a != @b`, `@a < @b`, `@a >= @b`,
+		`@a && @b`, `@a || @b`, `!@a`, `-@a`,
+		`@a[@b]`, `@a[]`, `@a[].b`, `@a[? @b]`, `@a[? .][0]`,
+		`.[@b]`, `.b`, `@a | .[0]`,
+		`@a ? 1 : 2`, `{(@a): @b}`, `[@a, @b]`,
+		`let $x = @a in $x[@b]`, `let $x = [@a, @b] in $x[1]`,
+	}
+
+	var names []string
+	for name := range builtinEnv.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := builtinEnv.funcs[name]
+		var args []string
+		for i, param := range f.Params {
+			switch {
+			case param == TypeExpr:
+				args = append(args, ".")
+			case i%2 == 0:
+				args = append(args, "@a")
+			default:
+				args = append(args, "@b")
+			}
+		}
+		queries = append(queries, name+"("+strings.Join(args, ", ")+")")
+	}
+
+	return queries
+}
+
+// allQueries returns the queries of the test tables and fuzzQueries, for
+// tests that check two ways of evaluating a query agree. Queries that give a
+// different result each time, those calling $now, are left out. Some of
+// the queries do not compile.
+func allQueries() []string {
+	registerTestFuncs()
+
+	var exps []string
+	for _, test := range Tests {
+		exps = append(exps, test.exp)
+	}
+	for _, test := range PrecedenceTests {
+		exps = append(exps, test.exp)
+	}
+	for _, test := range ErrorTests {
+		exps = append(exps, test.exp)
+	}
+	for _, test := range OptimizeTests {
+		exps = append(exps, test.exp)
+	}
+	for _, test := range ProjectionTests {
+		exps = append(exps, test.exp)
+	}
+	exps = append(exps, fuzzQueries()...)
+
+	var queries []string
+	for _, exp := range exps {
+		tokens, _ := Lexer(exp)
+		tree, _ := Parser(tokens)
+		if !callsFunc(tree, "$now") {
+			queries = append(queries, exp)
+		}
+	}
+	return queries
+}
+
+// callsFunc reports whether the tree t calls the function name. A variable
+// bound by let with the same name is not a call.
+func callsFunc(t *TokenTree, name string) bool {
+	if t == nil {
+		return false
+	}
+	if t.Type == FUNC && t.Value == name {
+		return true
+	}
+	for _, sub := range t.Tokens {
+		if callsFunc(sub, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzBuiltins(f *testing.F) {
+	for _, seed := range [][2]string{
+		{`[1, 2, 3]`, `2`},
+		{`[]`, `null`},
+		{`["a", 1, null, true]`, `"a"`},
+		{`[null]`, `null`},
+		{`[[1], {"a": 1}]`, `[1]`},
+		{`{"a": [true], "b": false}`, `"a"`},
+		{`"2006-01-02"`, `"2014-05-01"`},
+		{`"("`, `"x"`},
+		{`-1e300`, `1e300`},
+		{`0`, `0`},
+		{`true`, `[true, false]`},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+
+	var exprs []*Expression
+	for _, q := range fuzzQueries() {
+		exprs = append(exprs, MustCompile(q))
+	}
+
+	f.Fuzz(func(t *testing.T, a, b string) {
+		var va, vb interface{}
+		if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+			t.Skip()
+		}
+
+		vars := map[string]interface{}{"a": va, "b": vb}
+		for _, e := range exprs {
+			_, err := e.EvalWithVars(va, vars)
+			if err == nil {
+				continue
+			}
+
+			ee, ok := err.(*EvalError)
+			if !ok {
+				t.Errorf("%s with a=%s b=%s: expected *EvalError, got %T: %s", e, a, b, err, err)
+			} else if ee.Kind == PanicError {
+				t.Errorf("%s with a=%s b=%s: %s", e, a, b, err)
+			}
+		}
+	})
+}
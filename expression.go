@@ -0,0 +1,137 @@
+package jee
+
+// Expression is a compiled jee query. An Expression is never modified after
+// Compile returns, so a single Expression may be evaluated concurrently from
+// any number of goroutines.
+type Expression struct {
+	source string
+	tree   *TokenTree
+	// the functions the expression calls, resolved at compile time
+	funcs map[string]*Func
+	// the tree compiled to bytecode, which is what is evaluated
+	prog *program
+	// the part of a message the expression reads, for EvalBytes
+	proj *projection
+	// EvalBytes decodes numbers as json.Number
+	useNumber bool
+}
+
+// Option configures how an expression is compiled.
+type Option func(*options)
+
+type options struct {
+	env       *Env
+	err       error
+	optimize  bool
+	useNumber bool
+}
+
+// WithFunc makes fn callable as $name from the compiled expression only.
+func WithFunc(name string, fn *Func) Option {
+	return func(o *options) {
+		if err := o.env.RegisterFunc(name, fn); err != nil && o.err == nil {
+			o.err = err
+		}
+	}
+}
+
+// WithOptimizer makes Compile optimize the expression. See Optimize.
+func WithOptimizer() Option {
+	return func(o *options) {
+		o.optimize = true
+	}
+}
+
+// WithUseNumber makes EvalBytes decode the numbers in a document as
+// json.Number, like a json.Decoder with UseNumber, so that integers too large
+// for a float64 stay exact.
+func WithUseNumber() Option {
+	return func(o *options) {
+		o.useNumber = true
+	}
+}
+
+// Compile lexes and parses a jee query into an Expression that can call the
+// built-in functions and every function registered with RegisterFunc.
+func Compile(input string, opts ...Option) (*Expression, error) {
+	return globalEnv.Compile(input, opts...)
+}
+
+// Compile lexes and parses a jee query into an Expression that can call the
+// functions of e. Every function the query calls must exist and accept the
+// number of arguments it is given.
+func (e *Env) Compile(input string, opts ...Option) (*Expression, error) {
+	o := &options{
+		env: &Env{parent: e, funcs: map[string]*Func{}},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	tokens, err := Lexer(input)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := parse(tokens, o.env)
+	if err != nil {
+		return nil, withQuery(err, input)
+	}
+
+	funcs := map[string]*Func{}
+	if err := o.env.resolveFuncs(tree, funcs); err != nil {
+		return nil, withQuery(err, input)
+	}
+
+	if o.optimize {
+		tree = optimize(tree, funcs)
+	}
+
+	return &Expression{
+		source: input,
+		tree:   tree,
+		funcs:  funcs,
+		prog:   compileProgram(tree, funcs),
+		proj:   project(tree, funcs),
+
+		useNumber: o.useNumber,
+	}, nil
+}
+
+// MustCompile is like Compile but panics if the query cannot be compiled.
+func MustCompile(input string, opts ...Option) *Expression {
+	e, err := Compile(input, opts...)
+	if err != nil {
+		panic("jee: Compile(" + input + "): " + err.Error())
+	}
+	return e
+}
+
+// Eval evaluates the expression against msg.
+func (e *Expression) Eval(msg BMsg) (result interface{}, err error) {
+	defer recoverEval(&err)
+	result, err = e.prog.eval(msg, nil)
+	if err != nil {
+		return nil, withQuery(err, e.source)
+	}
+	return result, nil
+}
+
+// EvalWithVars evaluates the expression against msg with the external
+// variables referenced as @name in the query bound to vars.
+func (e *Expression) EvalWithVars(msg BMsg, vars map[string]interface{}) (result interface{}, err error) {
+	defer recoverEval(&err)
+	result, err = e.prog.eval(msg, vars)
+	if err != nil {
+		return nil, withQuery(err, e.source)
+	}
+	return result, nil
+}
+
+// String returns the source query the expression was compiled from.
+func (e *Expression) String() string {
+	return e.source
+}
@@ -0,0 +1,224 @@
+package jee
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func copyTree(t *TokenTree) *TokenTree {
+	c := &TokenTree{
+		Type:  t.Type,
+		Value: t.Value,
+	}
+	for _, sub := range t.Tokens {
+		c.Tokens = append(c.Tokens, copyTree(sub))
+	}
+	return c
+}
+
+// treesEqual compares two trees ignoring Parent pointers
+func treesEqual(a, b *TokenTree) bool {
+	if a.Type != b.Type || !reflect.DeepEqual(a.Value, b.Value) || len(a.Tokens) != len(b.Tokens) {
+		return false
+	}
+	for i := range a.Tokens {
+		if !treesEqual(a.Tokens[i], b.Tokens[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCompile(t *testing.T) {
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+
+	for _, test := range Tests {
+		e, err := Compile(test.exp)
+		if err != nil {
+			t.Error("failed compile", test.exp, err)
+			continue
+		}
+
+		result, err := e.Eval(umsg)
+		if err != nil {
+			t.Error("failed eval", test.exp, err)
+			continue
+		}
+
+		var rmsg BMsg
+		json.Unmarshal([]byte(test.result), &rmsg)
+		if !reflect.DeepEqual(rmsg, result) {
+			t.Error(test.exp, "expected", rmsg, "got", result)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, exp := range []string{`(.a`, `.a]`, `foo`, "\x00"} {
+		if _, err := Compile(exp); err == nil {
+			t.Error("expected compile error for", exp)
+		}
+	}
+}
+
+func TestEvalDoesNotMutate(t *testing.T) {
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+
+	for _, test := range Tests {
+		e, err := Compile(test.exp)
+		if err != nil {
+			t.Error("failed compile", test.exp, err)
+			continue
+		}
+
+		before := copyTree(e.tree)
+		e.Eval(umsg)
+		if !treesEqual(before, e.tree) {
+			t.Error("tree was modified by eval:", test.exp)
+		}
+	}
+}
+
+func TestBracketKeyReuse(t *testing.T) {
+	e := MustCompile(`.[.key][.index]`)
+
+	msgs := []map[string]interface{}{
+		{"key": "a", "index": 0.0, "a": []interface{}{"first"}},
+		{"key": "b", "index": 1.0, "b": []interface{}{"x", "second"}},
+	}
+
+	for _, want := range []string{"first", "second", "first"} {
+		msg := msgs[0]
+		if want == "second" {
+			msg = msgs[1]
+		}
+		result, err := e.Eval(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != want {
+			t.Error("expected", want, "got", result)
+		}
+	}
+}
+
+// run with -race to check that a shared Expression is goroutine safe
+func TestExpressionConcurrent(t *testing.T) {
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+
+	type compiled struct {
+		e    *Expression
+		want interface{}
+	}
+
+	var exps []compiled
+	for _, test := range Tests {
+		e, err := Compile(test.exp)
+		if err != nil {
+			t.Fatal("failed compile", test.exp, err)
+		}
+		var want BMsg
+		json.Unmarshal([]byte(test.result), &want)
+		exps = append(exps, compiled{e, want})
+	}
+
+	bracket := MustCompile(`.[.key]`)
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 64)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				for _, c := range exps {
+					result, err := c.e.Eval(umsg)
+					if err != nil {
+						errs <- c.e.String() + ": " + err.Error()
+						return
+					}
+					if !reflect.DeepEqual(c.want, result) {
+						errs <- c.e.String() + ": unexpected result"
+						return
+					}
+				}
+
+				key := "a"
+				if (g+i)%2 == 0 {
+					key = "b"
+				}
+				msg := map[string]interface{}{"key": key, "a": "A", "b": "B"}
+				result, err := bracket.Eval(msg)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				if result != msg[key].(string) {
+					errs <- "bracket key resolved against the wrong message"
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestKeysOfNonObjects pins down what keys of values that are not objects
+// evaluate to. .name of a number, string or array is null, but ["name"] and
+// [0] are errors. Any key of a null or missing value is null.
+func TestKeysOfNonObjects(t *testing.T) {
+	msg := map[string]interface{}{"n": 1.0, "s": "x", "a": []interface{}{1.0}, "z": nil}
+
+	for exp, ok := range map[string]bool{
+		`.n.x`:          true,
+		`.s.x`:          true,
+		`.a.x`:          true,
+		`.n.x.y`:        true,
+		`.n.x[0]`:       true,
+		`.z.x`:          true,
+		`.z["x"]`:       true,
+		`.z[0]`:         true,
+		`.missing[0]`:   true,
+		`.missing["x"]`: true,
+		`.n["x"]`:       false,
+		`.s["x"]`:       false,
+		`.a["x"]`:       false,
+		`.n[0]`:         false,
+		`.s[0]`:         false,
+	} {
+		e, err := Compile(exp)
+		if err != nil {
+			t.Error("failed compile", exp, err)
+			continue
+		}
+
+		result, err := e.Eval(msg)
+		if ok && (err != nil || result != nil) {
+			t.Errorf("%s: expected null, got %v %v", exp, result, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: expected an error, got %v", exp, result)
+		}
+	}
+
+	if _, err := MustCompile(`.x`).Eval(1.0); err == nil {
+		t.Error("expected an error for .x of a number")
+	}
+}
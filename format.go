@@ -0,0 +1,254 @@
+package jee
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// String returns the tree as canonical jee source. See Format.
+func (t *TokenTree) String() string {
+	var b strings.Builder
+	t.Format(&b)
+	return b.String()
+}
+
+// Format writes the tree as canonical jee source that parses back to an
+// identical tree. Strings are double quoted, binary operators are surrounded
+// by single spaces, conditionals are written as c ? a : b and parentheses are
+// only added where precedence requires them.
+func (t *TokenTree) Format(w io.Writer) error {
+	f := &formatter{}
+	if t.Type == ZERO {
+		// the root of a tree from Parser
+		if len(t.Tokens) > 0 {
+			f.expr(t.Tokens[0], precLowest)
+		}
+	} else {
+		f.expr(t, precLowest)
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+	_, err := io.WriteString(w, f.b.String())
+	return err
+}
+
+type formatter struct {
+	b   strings.Builder
+	err error
+}
+
+// nodePrecedence returns how tightly a node binds. Let expressions extend
+// as far to the right as they can, so they bind looser than any operator.
+func nodePrecedence(t *TokenTree) int {
+	switch t.Type {
+	case OP:
+		if len(t.Tokens) == 1 {
+			return precUnary
+		}
+		op, _ := t.Value.(string)
+		return binaryPrecedence[op]
+	case COND:
+		return precTernary
+	case LET, LAMBDA:
+		return precLowest
+	}
+	return precUnary + 1
+}
+
+// expr writes t, in parentheses if it binds looser than prec.
+func (f *formatter) expr(t *TokenTree, prec int) {
+	if nodePrecedence(t) < prec {
+		f.b.WriteString("(")
+		f.node(t)
+		f.b.WriteString(")")
+		return
+	}
+	f.node(t)
+}
+
+func (f *formatter) node(t *TokenTree) {
+	switch t.Type {
+	case CONST:
+		switch v := t.Value.(type) {
+		case float64:
+			f.b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+			if v == math.Trunc(v) && !isExactFloat(v) {
+				// without a fraction it would parse as an int64 or
+				// *big.Int, see parseNumber
+				f.b.WriteString(".0")
+			}
+		case int64:
+			f.b.WriteString(strconv.FormatInt(v, 10))
+		case *big.Int:
+			f.b.WriteString(v.String())
+		default:
+			f.fail(t)
+		}
+	case D_STR, S_STR:
+		s, ok := t.Value.(string)
+		if !ok {
+			f.fail(t)
+			return
+		}
+		f.str(s)
+	case RESERVED:
+		switch t.Value {
+		case true:
+			f.b.WriteString("true")
+		case false:
+			f.b.WriteString("false")
+		case nil:
+			f.b.WriteString("null")
+		default:
+			f.fail(t)
+		}
+	case KEY:
+		f.b.WriteString(".")
+		f.b.WriteString(f.name(t))
+		f.accessors(t)
+	case VAR:
+		f.b.WriteString(f.name(t))
+		f.accessors(t)
+	case EXT:
+		f.b.WriteString("@")
+		f.b.WriteString(f.name(t))
+		f.accessors(t)
+	case FUNC:
+		// always write the parentheses, a name bound by let without
+		// them is a variable
+		f.b.WriteString(f.name(t))
+		f.list("(", t.Tokens, ")")
+	case LAMBDA:
+		f.b.WriteString(f.name(t))
+		f.b.WriteString(" -> ")
+		f.expr(t.Tokens[0], precLowest)
+	case OP:
+		op := f.name(t)
+		if len(t.Tokens) == 1 {
+			f.b.WriteString(op)
+			f.expr(t.Tokens[0], precUnary)
+			return
+		}
+
+		// every binary operator is left associative
+		prec := binaryPrecedence[op]
+		f.expr(t.Tokens[0], prec)
+		f.b.WriteString(" " + op + " ")
+		f.expr(t.Tokens[1], prec+1)
+	case COND:
+		f.expr(t.Tokens[0], precTernary+1)
+		f.b.WriteString(" ? ")
+		f.expr(t.Tokens[1], precLowest)
+		f.b.WriteString(" : ")
+		f.expr(t.Tokens[2], precTernary)
+	case LET:
+		f.b.WriteString("let ")
+		for {
+			f.b.WriteString(f.name(t))
+			f.b.WriteString(" = ")
+			f.expr(t.Tokens[0], precLowest)
+
+			// let $a = 1 in let $b = 2 in x is let $a = 1, $b = 2 in x
+			if t.Tokens[1].Type != LET {
+				break
+			}
+			f.b.WriteString(", ")
+			t = t.Tokens[1]
+		}
+		f.b.WriteString(" in ")
+		f.expr(t.Tokens[1], precLowest)
+	case ARRAY:
+		f.list("[", t.Tokens, "]")
+	case OBJECT:
+		f.b.WriteString("{")
+		for i := 0; i+1 < len(t.Tokens); i += 2 {
+			if i > 0 {
+				f.b.WriteString(", ")
+			}
+			if key := t.Tokens[i]; key.Type == D_STR || key.Type == S_STR {
+				f.node(key)
+			} else {
+				// a computed key
+				f.b.WriteString("(")
+				f.expr(key, precLowest)
+				f.b.WriteString(")")
+			}
+			f.b.WriteString(": ")
+			f.expr(t.Tokens[i+1], precLowest)
+		}
+		f.b.WriteString("}")
+	default:
+		f.fail(t)
+	}
+}
+
+// accessors writes the .key, [expr], [] and [? predicate] accessors of a KEY,
+// VAR or EXT node.
+func (f *formatter) accessors(t *TokenTree) {
+	for _, sub := range t.Tokens {
+		switch {
+		case sub.Type == KEY:
+			f.b.WriteString(".")
+			f.b.WriteString(f.name(sub))
+		case sub.Type == K_START && len(sub.Tokens) == 0:
+			f.b.WriteString("[]")
+		case sub.Type == K_START:
+			f.b.WriteString("[")
+			f.expr(sub.Tokens[0], precLowest)
+			f.b.WriteString("]")
+		case sub.Type == FILTER:
+			f.b.WriteString("[? ")
+			f.expr(sub.Tokens[0], precLowest)
+			f.b.WriteString("]")
+		default:
+			f.fail(sub)
+		}
+	}
+}
+
+// list writes comma separated expressions between open and close.
+func (f *formatter) list(open string, tokens []*TokenTree, close string) {
+	f.b.WriteString(open)
+	for i, sub := range tokens {
+		if i > 0 {
+			f.b.WriteString(", ")
+		}
+		f.expr(sub, precLowest)
+	}
+	f.b.WriteString(close)
+}
+
+// str writes s double quoted. Only quotes and escape chars are escaped; any
+// other character, including a newline, stands for itself in a jee string.
+func (f *formatter) str(s string) {
+	f.b.WriteString(`"`)
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			f.b.WriteRune('\\')
+		}
+		f.b.WriteRune(r)
+	}
+	f.b.WriteString(`"`)
+}
+
+// name returns the name of a key, variable, function or operator
+func (f *formatter) name(t *TokenTree) string {
+	s, ok := t.Value.(string)
+	if !ok {
+		f.fail(t)
+	}
+	return s
+}
+
+func (f *formatter) fail(t *TokenTree) {
+	if f.err == nil {
+		f.err = errors.New(fmt.Sprintf("cannot format %s node: %v", IdentStr[t.Type], t.Value))
+	}
+}
@@ -0,0 +1,251 @@
+package jee
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+type FormatTest struct {
+	exp       string
+	formatted string
+}
+
+var FormatTests = []FormatTest{
+	FormatTest{exp: ``, formatted: ``},
+	FormatTest{exp: `.`, formatted: `.`},
+	FormatTest{exp: `1.50`, formatted: `1.5`},
+	FormatTest{exp: `9007199254740993`, formatted: `9007199254740993`},
+	FormatTest{exp: `-123456789012345678901234567890`, formatted: `-123456789012345678901234567890`},
+	FormatTest{exp: `(1 + 2) * 3`, formatted: `(1 + 2) * 3`},
+	FormatTest{exp: `1 + (2 * 3)`, formatted: `1 + 2 * 3`},
+	FormatTest{exp: `(1 - 2) - 3`, formatted: `1 - 2 - 3`},
+	FormatTest{exp: `1 - (2 - 3)`, formatted: `1 - (2 - 3)`},
+	FormatTest{exp: `1-(-2)`, formatted: `1 - -2`},
+	FormatTest{exp: `-(-(.a))`, formatted: `--.a`},
+	FormatTest{exp: `!(.a && .b)`, formatted: `!(.a && .b)`},
+	FormatTest{exp: `((.a || .b)) && !.c`, formatted: `(.a || .b) && !.c`},
+	FormatTest{exp: `'a'`, formatted: `"a"`},
+	FormatTest{exp: `'say "hi"'`, formatted: `"say \"hi\""`},
+	FormatTest{exp: `"a\\b"`, formatted: `"a\\b"`},
+	FormatTest{exp: `if .a then 1 elif .b then 2 else 3 end`, formatted: `.a ? 1 : .b ? 2 : 3`},
+	FormatTest{exp: `(.a ? .b : .c) ? 1 : 2`, formatted: `(.a ? .b : .c) ? 1 : 2`},
+	FormatTest{exp: `.a ? (.b | .c) : (.d | .e)`, formatted: `.a ? .b | .c : (.d | .e)`},
+	FormatTest{exp: `let $a = 1 in let $b = $a in $a + $b`, formatted: `let $a = 1, $b = $a in $a + $b`},
+	FormatTest{exp: `(let $x = 1 in $x) + 1`, formatted: `(let $x = 1 in $x) + 1`},
+	FormatTest{exp: `{a: 1, 'b': [], (.c): {}}`, formatted: `{"a": 1, "b": [], (.c): {}}`},
+	FormatTest{exp: `$map(.a,$x->$x*2)`, formatted: `$map(.a, $x -> $x * 2)`},
+	FormatTest{exp: `$now`, formatted: `$now()`},
+	FormatTest{exp: `.a[0].b[]['c'][? . > 1]`, formatted: `.a[0].b[]["c"][? . > 1]`},
+	FormatTest{exp: `@x.y[(1)]`, formatted: `@x.y[1]`},
+	FormatTest{exp: `.a | .b | .c`, formatted: `.a | .b | .c`},
+	FormatTest{exp: `.a | (.b | .c)`, formatted: `.a | (.b | .c)`},
+	FormatTest{exp: `.a | .b ? 1 : 2`, formatted: `.a | .b ? 1 : 2`},
+}
+
+func parseString(t *testing.T, exp string) *TokenTree {
+	tokens, err := Lexer(exp)
+	if err != nil {
+		t.Fatal("failed lex", exp, err)
+	}
+	tree, err := Parser(tokens)
+	if err != nil {
+		t.Fatal("failed parse", exp, err)
+	}
+	return tree
+}
+
+func TestFormat(t *testing.T) {
+	for _, test := range FormatTests {
+		tree := parseString(t, test.exp)
+		if s := tree.String(); s != test.formatted {
+			t.Errorf("%s: expected %s, got %s", test.exp, test.formatted, s)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	var exps []string
+	for _, test := range Tests {
+		exps = append(exps, test.exp)
+	}
+	for _, test := range PrecedenceTests {
+		exps = append(exps, test.exp)
+	}
+	for _, test := range FormatTests {
+		exps = append(exps, test.exp)
+	}
+	for _, test := range OptimizeTests {
+		exps = append(exps, test.exp)
+	}
+
+	for _, exp := range exps {
+		tree := parseString(t, exp)
+
+		// the optimizer folds constants into trees Parser must also read back
+		for _, tree := range []*TokenTree{tree, Optimize(tree)} {
+			formatted := tree.String()
+
+			reparsed := parseString(t, formatted)
+			if !treesEqual(tree, reparsed) {
+				t.Errorf("%s: formatted as %s, which parses to a different tree", exp, formatted)
+				continue
+			}
+
+			if again := reparsed.String(); again != formatted {
+				t.Errorf("%s: formatted as %s, then as %s", exp, formatted, again)
+			}
+		}
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	var b strings.Builder
+	tree := &TokenTree{Type: CONST, Value: "1"}
+	if err := tree.Format(&b); err == nil {
+		t.Error("expected error formatting a CONST with a string value")
+	}
+}
+
+// treeGen generates random trees of the shape Parser produces
+type treeGen struct {
+	r *rand.Rand
+	// variables bound where the next node is generated
+	vars []string
+}
+
+var genStrings = []string{"", "a", "hello world", `"`, `\`, `\"`, "'", "é", "tab\tnew\nline", "()[]{}.,?:@$|"}
+var genNames = []string{"a", "b1", "_c", "true", "if"}
+var genOps = []string{"|", "||", "&&", "==", "!=", ">", ">=", "<", "<=", "+", "-", "*", "/"}
+
+func (g *treeGen) name() string {
+	return genNames[g.r.Intn(len(genNames))]
+}
+
+func (g *treeGen) leaf() *TokenTree {
+	switch g.r.Intn(8) {
+	case 0:
+		return newTree(Position{}, CONST, float64(g.r.Intn(2000))/8)
+	case 1:
+		return newTree(Position{}, D_STR, genStrings[g.r.Intn(len(genStrings))])
+	case 2:
+		return newTree(Position{}, RESERVED, []interface{}{true, false, nil}[g.r.Intn(3)])
+	case 3:
+		return newTree(Position{}, EXT, g.name())
+	case 4:
+		if len(g.vars) > 0 {
+			return newTree(Position{}, VAR, g.vars[g.r.Intn(len(g.vars))])
+		}
+		return newTree(Position{}, FUNC, "$f")
+	case 5:
+		return newTree(Position{}, KEY, "")
+	}
+	return newTree(Position{}, KEY, g.name())
+}
+
+// bind generates an expression with name bound
+func (g *treeGen) bind(name string, depth int) *TokenTree {
+	g.vars = append(g.vars, name)
+	t := g.expr(depth)
+	g.vars = g.vars[:len(g.vars)-1]
+	return t
+}
+
+func (g *treeGen) expr(depth int) *TokenTree {
+	if depth <= 0 {
+		return g.leaf()
+	}
+	depth--
+
+	switch g.r.Intn(12) {
+	case 0, 1:
+		op := genOps[g.r.Intn(len(genOps))]
+		return newTree(Position{}, OP, op, g.expr(depth), g.expr(depth))
+	case 2:
+		op := []string{"-", "!"}[g.r.Intn(2)]
+		return newTree(Position{}, OP, op, g.expr(depth))
+	case 3:
+		return newTree(Position{}, COND, nil, g.expr(depth), g.expr(depth), g.expr(depth))
+	case 4:
+		name := "$" + g.name()
+		return newTree(Position{}, LET, name, g.expr(depth), g.bind(name, depth))
+	case 5:
+		t := newTree(Position{}, ARRAY, nil)
+		for i := g.r.Intn(3); i > 0; i-- {
+			appendTree(t, g.expr(depth))
+		}
+		return t
+	case 6:
+		t := newTree(Position{}, OBJECT, nil)
+		for i := g.r.Intn(3); i > 0; i-- {
+			if g.r.Intn(2) == 0 {
+				appendTree(t, newTree(Position{}, D_STR, genStrings[g.r.Intn(len(genStrings))]))
+			} else {
+				appendTree(t, g.expr(depth))
+			}
+			appendTree(t, g.expr(depth))
+		}
+		return t
+	case 7:
+		t := newTree(Position{}, FUNC, []string{"$f", "$g"}[g.r.Intn(2)])
+		for i := g.r.Intn(3); i > 0; i-- {
+			if g.r.Intn(3) == 0 {
+				name := "$" + g.name()
+				appendTree(t, newTree(Position{}, LAMBDA, name, g.bind(name, depth)))
+			} else {
+				appendTree(t, g.expr(depth))
+			}
+		}
+		return t
+	case 8, 9:
+		var t *TokenTree
+		switch g.r.Intn(3) {
+		case 0:
+			t = newTree(Position{}, EXT, g.name())
+		case 1:
+			if len(g.vars) > 0 {
+				t = newTree(Position{}, VAR, g.vars[g.r.Intn(len(g.vars))])
+				break
+			}
+			fallthrough
+		default:
+			t = newTree(Position{}, KEY, g.name())
+		}
+		for i := g.r.Intn(4); i > 0; i-- {
+			switch g.r.Intn(4) {
+			case 0:
+				appendTree(t, newTree(Position{}, KEY, g.name()))
+			case 1:
+				appendTree(t, newTree(Position{}, K_START, nil))
+			case 2:
+				appendTree(t, newTree(Position{}, K_START, nil, g.expr(depth)))
+			case 3:
+				appendTree(t, newTree(Position{}, FILTER, nil, g.expr(depth)))
+			}
+		}
+		return t
+	}
+	return g.leaf()
+}
+
+func TestFormatParsesToSameTree(t *testing.T) {
+	g := &treeGen{r: rand.New(rand.NewSource(1))}
+
+	for i := 0; i < 5000; i++ {
+		tree := newTree(Position{}, ZERO, nil, g.expr(1+i%5))
+		formatted := tree.String()
+
+		tokens, err := Lexer(formatted)
+		if err != nil {
+			t.Fatalf("%s: failed lex: %s", formatted, err)
+		}
+		reparsed, err := Parser(tokens)
+		if err != nil {
+			t.Fatalf("%s: failed parse: %s", formatted, err)
+		}
+
+		if !treesEqual(tree, reparsed) {
+			t.Fatalf("%s parses to a different tree, formatted as %s", formatted, reparsed)
+		}
+	}
+}
@@ -2,15 +2,16 @@ package jee
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -30,6 +31,18 @@ const (
 	ESC
 	RESERVED
 	EQ
+	TERNARY
+	COLON
+	COND
+	LET
+	VAR
+	EXT
+	O_START
+	O_END
+	OBJECT
+	ARRAY
+	FILTER
+	LAMBDA
 )
 
 var Ident = map[rune]int{
@@ -53,6 +66,11 @@ var Ident = map[rune]int{
 	'\'': S_STR,
 	'\\': ESC,
 	',':  NEXT,
+	'?':  TERNARY,
+	':':  COLON,
+	'@':  EXT,
+	'{':  O_START,
+	'}':  O_END,
 }
 
 var IdentStr = map[int]string{
@@ -69,13 +87,59 @@ var IdentStr = map[int]string{
 	S_STR:    "S_STR",
 	RESERVED: "RES",
 	EQ:       "EQ",
+	TERNARY:  "TERNARY",
+	COLON:    "COLON",
+	COND:     "COND",
+	LET:      "LET",
+	VAR:      "VAR",
+	EXT:      "EXT",
+	O_START:  "O_START",
+	O_END:    "O_END",
+	OBJECT:   "OBJECT",
+	ARRAY:    "ARRAY",
+	FILTER:   "FILTER",
+	LAMBDA:   "LAMBDA",
 }
 
 type BMsg interface{}
 
+// Position is a location in a query.
+type Position struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Col    int // column in characters, starting at 1
+}
+
+// IsValid reports whether the position is known.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("line %d, col %d", p.Line, p.Col)
+}
+
+// advance returns the position after s, which starts at p.
+func (p Position) advance(s string) Position {
+	for _, r := range s {
+		p.Offset += utf8.RuneLen(r)
+		if r == '\n' {
+			p.Line++
+			p.Col = 1
+		} else {
+			p.Col++
+		}
+	}
+	return p
+}
+
 type Token struct {
 	Type  int
 	Value string
+	// where the token starts in the query
+	Pos Position
+	// the query the token was lexed from
+	query string
 }
 
 type TokenTree struct {
@@ -83,6 +147,17 @@ type TokenTree struct {
 	Value  interface{}
 	Tokens []*TokenTree
 	Parent *TokenTree
+	// where the token the node was built from starts in the query
+	Pos Position
+	// the query the tree was parsed from, kept on the root so that errors
+	// from Eval can show where they occurred
+	query string
+}
+
+// operators lists every operator the lexer can produce
+var operators = []string{
+	"+", "-", "*", "/", "!", "=", "|",
+	"==", "!=", ">", ">=", "<", "<=", "&&", "||", "->",
 }
 
 var tokenPopMap = map[int]func(rune, string) bool{
@@ -102,43 +177,48 @@ var tokenPopMap = map[int]func(rune, string) bool{
 	},
 	KEY: func(r rune, c string) bool {
 		switch getIdent(r) {
-		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, KEY, D_STR, S_STR:
+		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, KEY, D_STR, S_STR, TERNARY, COLON, O_START, O_END:
 			return true
 		}
 		return false
 	},
 	OP: func(r rune, c string) bool {
-		switch c {
-		case "*", "+", "-", "/":
+		if getIdent(r) != OP {
 			return true
 		}
 
-		if len(c) >= 2 {
-			return true
+		// keep reading while we are still spelling a known operator
+		for _, op := range operators {
+			if strings.HasPrefix(op, c+string(r)) {
+				return false
+			}
 		}
+		return true
+	},
+	CONST: func(r rune, c string) bool {
 		switch getIdent(r) {
-		case Q_START, Q_END, K_START, K_END, FUNC, CONST, KEY, D_STR, S_STR, RESERVED:
+		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, D_STR, S_STR, RESERVED, TERNARY, COLON, O_START, O_END:
 			return true
 		}
 		return false
 	},
-	CONST: func(r rune, c string) bool {
+	FUNC: func(r rune, c string) bool {
 		switch getIdent(r) {
-		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, D_STR, S_STR, RESERVED:
+		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, KEY, D_STR, S_STR, TERNARY, COLON, O_START, O_END:
 			return true
 		}
 		return false
 	},
-	FUNC: func(r rune, c string) bool {
+	EXT: func(r rune, c string) bool {
 		switch getIdent(r) {
-		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, KEY, D_STR, S_STR:
+		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, KEY, D_STR, S_STR, TERNARY, COLON, EXT, O_START, O_END:
 			return true
 		}
 		return false
 	},
 	RESERVED: func(r rune, c string) bool {
 		switch getIdent(r) {
-		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, KEY, D_STR, S_STR:
+		case Q_START, Q_END, K_START, K_END, OP, FUNC, NEXT, KEY, D_STR, S_STR, TERNARY, COLON, O_START, O_END:
 			return true
 		}
 		return false
@@ -160,10 +240,11 @@ func getIdent(r rune) int {
 	return ZERO
 }
 
-func emitToken(t []*Token, state int, value string) ([]*Token, string) {
+func emitToken(t []*Token, state int, value string, pos Position) ([]*Token, string) {
 	t = append(t, &Token{
 		Type:  state,
 		Value: value,
+		Pos:   pos,
 	})
 	return t, ""
 }
@@ -175,28 +256,39 @@ func Lexer(input string) ([]*Token, error) {
 	var state int
 	var poppedStr bool
 	var escaped bool
+	var start Position
+	pos := Position{Line: 1, Col: 1}
 
-	for _, r := range input {
+	for i, r := range input {
+		pos.Offset = i
+		at := pos
+		pos = pos.advance(string(r))
 
-		// if we have a space and we aren't in a string
+		// if we have a space and we aren't in a string, end the current
+		// word so that keywords like `then` are not glued to a key
 		if getIdent(r) == SPACE && state != D_STR && state != S_STR {
+			if len(currWord) > 0 {
+				tokens, currWord = emitToken(tokens, state, currWord, start)
+			}
+			state = ZERO
 			continue
 		}
 
-		// if we have an escape char and we are in a string
-		if getIdent(r) == ESC && (state == D_STR || state == S_STR) {
+		// if we have an escape char and we are in a string. an escaped
+		// escape char is kept.
+		if getIdent(r) == ESC && (state == D_STR || state == S_STR) && !escaped {
 			escaped = true
 			continue
 		}
 
 		if getIdent(r) == ZERO && state != D_STR && state != S_STR {
-			return nil, errors.New(fmt.Sprintf("unexpected token: %s", string(r)))
+			return nil, &CompileError{Pos: at, Msg: fmt.Sprintf("unexpected token: %s", string(r)), Query: input}
 		}
 
 		switch state {
-		case OP, FUNC, CONST, KEY, RESERVED:
+		case OP, FUNC, CONST, KEY, RESERVED, EXT:
 			if tokenPopMap[state](r, currWord) {
-				tokens, currWord = emitToken(tokens, state, currWord)
+				tokens, currWord = emitToken(tokens, state, currWord, start)
 			}
 		case D_STR, S_STR:
 			if escaped {
@@ -205,19 +297,20 @@ func Lexer(input string) ([]*Token, error) {
 			}
 			if tokenPopMap[state](r, currWord) {
 				currWord += string(r)
-				tokens, currWord = emitToken(tokens, state, currWord)
+				tokens, currWord = emitToken(tokens, state, currWord, start)
 				poppedStr = true
 			} else {
 				poppedStr = false
 			}
-		case Q_START, Q_END, K_START, K_END, NEXT:
-			tokens, currWord = emitToken(tokens, state, currWord)
+		case Q_START, Q_END, K_START, K_END, NEXT, TERNARY, COLON, O_START, O_END:
+			tokens, currWord = emitToken(tokens, state, currWord, start)
 		}
 
 		if !poppedStr {
 			if len(currWord) == 0 {
 				currWord = string(r)
 				state = getIdent(r)
+				start = at
 			} else {
 				currWord += string(r)
 			}
@@ -227,284 +320,615 @@ func Lexer(input string) ([]*Token, error) {
 		}
 	}
 
+	if state == D_STR || state == S_STR {
+		return nil, &CompileError{Pos: start, Msg: "unterminated string", Query: input}
+	}
+
 	if len(currWord) > 0 {
-		tokens, _ = emitToken(tokens, state, currWord)
+		tokens, _ = emitToken(tokens, state, currWord, start)
 	}
 
+	for _, t := range tokens {
+		t.query = input
+	}
 	return tokens, nil
 }
 
-func buildTree(tokens []*Token) (*TokenTree, error) {
-	var state int
-	tree := &TokenTree{}
-	var inKey bool // TODO: this needs to go
-	var nested int
-	var knested int
+// Operator precedence levels, from loosest to tightest binding. Every binary
+// operator is left associative, so 1 - 2 - 3 is (1 - 2) - 3. The unary
+// operators - and ! bind tighter than any binary operator. The ternary
+// conditional is right associative and binds looser than every operator
+// except the pipe.
+const (
+	precLowest         = iota
+	precPipe           // a | b
+	precTernary        // c ? a : b
+	precOr             // ||
+	precAnd            // &&
+	precComparison     // == != > >= < <=
+	precAdditive       // + -
+	precMultiplicative // * /
+	precUnary          // -x !x
+)
+
+var binaryPrecedence = map[string]int{
+	"|":  precPipe,
+	"||": precOr,
+	"&&": precAnd,
+	"==": precComparison,
+	"!=": precComparison,
+	">":  precComparison,
+	">=": precComparison,
+	"<":  precComparison,
+	"<=": precComparison,
+	"+":  precAdditive,
+	"-":  precAdditive,
+	"*":  precMultiplicative,
+	"/":  precMultiplicative,
+}
 
-	// first pass:
-	// take care of quantities, funcs, keys.
+// parser is a precedence climbing (Pratt) parser over the output of Lexer.
+type parser struct {
+	tokens []*Token
+	pos    int
+	// names of the variables bound by the enclosing let expressions
+	vars []string
+	// functions that can be called
+	env *Env
+	// the position after the last token
+	end Position
+}
+
+func newTree(pos Position, tokenType int, value interface{}, tokens ...*TokenTree) *TokenTree {
+	tree := &TokenTree{
+		Type:   tokenType,
+		Value:  value,
+		Tokens: tokens,
+		Pos:    pos,
+	}
 	for _, t := range tokens {
+		t.Parent = tree
+	}
+	return tree
+}
 
-		item := &TokenTree{
-			Value:  t.Value,
-			Type:   t.Type,
-			Parent: tree,
-		}
+func appendTree(tree *TokenTree, t *TokenTree) {
+	t.Parent = tree
+	tree.Tokens = append(tree.Tokens, t)
+}
 
-		// this item should probably be in Lexer
-		// convert value to float64 if number
-		if item.Type == CONST {
-			f, err := strconv.ParseFloat(t.Value, 64)
-			if err != nil {
+func (p *parser) peek() *Token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return nil
+}
 
-			} else {
-				item.Value = f
+func (p *parser) next() *Token {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+// errorf returns a CompileError at the token t, or at the end of the query
+// if t is nil.
+func (p *parser) errorf(t *Token, format string, args ...interface{}) error {
+	pos := p.end
+	if t != nil {
+		pos = t.Pos
+	}
+	return &CompileError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) unexpected(t *Token) error {
+	switch {
+	case t == nil:
+		return p.errorf(t, "unexpected end of input")
+	case t.Type == Q_START, t.Type == Q_END, t.Type == K_END:
+		return p.errorf(t, "unbalanced () or []")
+	case t.Type == O_END:
+		return p.errorf(t, "unbalanced {}")
+	}
+	return p.errorf(t, "unexpected token: %s", t.Value)
+}
+
+// expect consumes the next token, which must be of type tokenType.
+func (p *parser) expect(tokenType int) error {
+	t := p.next()
+	if t == nil || t.Type != tokenType {
+		switch tokenType {
+		case Q_END, K_END:
+			return p.errorf(t, "unbalanced () or []")
+		case O_END:
+			return p.errorf(t, "unbalanced {}")
+		}
+		return p.unexpected(t)
+	}
+	return nil
+}
+
+// parseExpression parses operators that bind tighter than prec.
+func (p *parser) parseExpression(prec int) (*TokenTree, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t != nil && t.Type == TERNARY && precTernary > prec {
+			p.next()
+			left, err = p.parseTernary(t, left)
+			if err != nil {
+				return nil, err
 			}
+			continue
 		}
 
-		// this item should probably be in Lexer
-		// get rid of quotes around our strings
-		if item.Type == D_STR || item.Type == S_STR {
-			item.Value = item.Value.(string)[1 : len(item.Value.(string))-1]
+		if t == nil || t.Type != OP {
+			return left, nil
 		}
 
-		// this item should probably be in Lexer
-		// create bool type
-		if item.Type == RESERVED {
-			switch item.Value {
-			case "true", "false":
-				f, err := strconv.ParseBool(t.Value)
-				if err != nil {
-
-				} else {
-					item.Value = f
-				}
-			case "null":
-				item.Value = nil
-			default:
-				return nil, errors.New(fmt.Sprintf("unexpected token: %s", item.Value))
-			}
+		opPrec, ok := binaryPrecedence[t.Value]
+		if !ok {
+			return nil, p.unexpected(t)
 		}
 
-		//
-		if item.Type == K_START {
-			item.Value = nil
+		if opPrec <= prec {
+			return left, nil
 		}
 
-		// remove '.' from key name
-		if item.Type == KEY {
-			item.Value = item.Value.(string)[1:]
+		p.next()
+		right, err := p.parseExpression(opPrec)
+		if err != nil {
+			return nil, err
 		}
 
-		switch t.Type {
-		case FUNC, CONST, RESERVED, D_STR, S_STR, NEXT:
-			if inKey {
-				for tree.Parent != nil && tree.Type == KEY && (tree.Type == KEY || tree.Type == K_START) {
-					tree = tree.Parent
-				}
-				inKey = false
-			}
-			tree.Tokens = append(tree.Tokens, item)
-		case OP:
-			if inKey {
-				for tree.Parent != nil && tree.Type == KEY && (tree.Type == KEY || tree.Type == K_START) {
-					tree = tree.Parent
-				}
-				inKey = false
-			}
-			tree.Tokens = append(tree.Tokens, item)
-		case KEY:
-			tree.Tokens = append(tree.Tokens, item)
-			if !inKey {
-				tree = item
-			}
-			inKey = true
-		case Q_START:
-			nested++
-			if state == FUNC {
-				// we are a function
-				tree = tree.Tokens[len(tree.Tokens)-1]
-			} else {
-				// we are a quantity
-				tree.Tokens = append(tree.Tokens, item)
-				tree = item
-			}
-		case K_START:
-			if tree.Type != KEY && tree.Type != K_START {
-				return nil, errors.New("unexpected [")
-			}
+		left = newTree(t.Pos, OP, t.Value, left, right)
+	}
+}
 
-			knested++
-			tree.Tokens = append(tree.Tokens, item)
-			tree = item
+func (p *parser) parseUnary() (*TokenTree, error) {
+	t := p.peek()
+	if t != nil && t.Type == OP && (t.Value == "-" || t.Value == "!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return newTree(t.Pos, OP, t.Value, operand), nil
+	}
 
-		case K_END:
-			knested--
-			// ???????
-			if tree.Parent != nil {
-				tree = tree.Parent
-			} else {
-				return nil, errors.New("unbalanced () or []")
-			}
-			inKey = true
+	return p.parsePrimary()
+}
 
-		case Q_END:
-			nested--
-			if inKey {
-				for tree.Parent != nil && (tree.Type == KEY || tree.Type == K_START) {
-					tree = tree.Parent
-				}
-				inKey = false
-			}
+func (p *parser) parsePrimary() (*TokenTree, error) {
+	t := p.next()
+	if t == nil {
+		return nil, p.unexpected(t)
+	}
 
-			if tree.Parent != nil {
-				tree = tree.Parent
-			} else {
-				return nil, errors.New("unbalanced () or []")
-			}
+	switch t.Type {
+	case CONST:
+		// integers too large for a float64 stay exact
+		n, err := parseNumber(t.Value)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number: %s", t.Value)
+		}
+		return newTree(t.Pos, CONST, n), nil
+	case D_STR, S_STR:
+		// get rid of quotes around our strings. single and double quoted
+		// strings are the same.
+		return newTree(t.Pos, D_STR, t.Value[1:len(t.Value)-1]), nil
+	case RESERVED:
+		switch t.Value {
+		case "true":
+			return newTree(t.Pos, RESERVED, true), nil
+		case "false":
+			return newTree(t.Pos, RESERVED, false), nil
+		case "null":
+			return newTree(t.Pos, RESERVED, nil), nil
+		case "if":
+			return p.parseIf(t)
+		case "let":
+			return p.parseLet(t)
 		}
-
-		switch state {
-		default:
+	case KEY:
+		return p.parseKey(t)
+	case FUNC:
+		return p.parseFunc(t)
+	case EXT:
+		if len(t.Value) == 1 {
+			return nil, p.errorf(t, "expected variable name after @")
+		}
+		// remove '@' from variable name
+		return p.parseAccessors(newTree(t.Pos, EXT, t.Value[1:]))
+	case K_START:
+		return p.parseArray(t)
+	case O_START:
+		return p.parseObject(t)
+	case Q_START:
+		tree, err := p.parseExpression(precLowest)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(Q_END); err != nil {
+			return nil, err
 		}
+		return tree, nil
+	}
+
+	return nil, p.unexpected(t)
+}
 
-		state = t.Type
+// parseTernary parses the branches of cond ? a : b. Everything after the
+// colon is parsed at ternary precedence so that chained conditionals nest to
+// the right.
+func (p *parser) parseTernary(t *Token, cond *TokenTree) (*TokenTree, error) {
+	a, err := p.parseExpression(precLowest)
+	if err != nil {
+		return nil, err
 	}
 
-	if nested != 0 || knested != 0 {
-		return nil, errors.New("unbalanced () or []")
+	if err := p.expect(COLON); err != nil {
+		return nil, err
 	}
 
-	for tree.Parent != nil {
-		tree = tree.Parent
+	b, err := p.parseExpression(precTernary - 1)
+	if err != nil {
+		return nil, err
 	}
 
-	return tree, nil
+	return newTree(t.Pos, COND, nil, cond, a, b), nil
 }
 
-func not(tree *TokenTree) *TokenTree {
-	var negate *TokenTree
-	var newTokens []*TokenTree
+func (p *parser) expectReserved(word string) error {
+	t := p.next()
+	if t == nil {
+		return p.errorf(t, "expected %s, got end of input", word)
+	}
+	if t.Type != RESERVED || t.Value != word {
+		return p.errorf(t, "expected %s, got: %s", word, t.Value)
+	}
+	return nil
+}
 
-	for _, t := range tree.Tokens {
+// parseIf parses if c then a elif c2 then b else d end. An elif becomes a
+// conditional nested in the else branch of its parent.
+func (p *parser) parseIf(start *Token) (*TokenTree, error) {
+	cond, err := p.parseExpression(precLowest)
+	if err != nil {
+		return nil, err
+	}
 
-		if t.Type == OP && t.Value == "!" {
-			negate = t
-			newTokens = append(newTokens, t)
-			continue
-		}
+	if err := p.expectReserved("then"); err != nil {
+		return nil, err
+	}
 
-		if negate != nil {
-			negate.Tokens = append(negate.Tokens, t)
-			negate = nil
-		} else {
-			t.Parent = negate
-			newTokens = append(newTokens, t)
+	a, err := p.parseExpression(precLowest)
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.next()
+	if t == nil || t.Type != RESERVED {
+		return nil, p.unexpected(t)
+	}
+
+	var b *TokenTree
+	switch t.Value {
+	case "elif":
+		b, err = p.parseIf(t)
+		if err != nil {
+			return nil, err
+		}
+		return newTree(start.Pos, COND, nil, cond, a, b), nil
+	case "else":
+		b, err = p.parseExpression(precLowest)
+		if err != nil {
+			return nil, err
 		}
+	default:
+		return nil, p.unexpected(t)
+	}
 
-		if len(t.Tokens) > 0 {
-			t = not(t)
+	if err := p.expectReserved("end"); err != nil {
+		return nil, err
+	}
+
+	return newTree(start.Pos, COND, nil, cond, a, b), nil
+}
+
+func (p *parser) bound(name string) bool {
+	for _, v := range p.vars {
+		if v == name {
+			return true
 		}
 	}
+	return false
+}
+
+// parseLet parses let $a = x, $b = y in body. Each binding becomes a LET
+// node holding the bound value and the expression it is visible in, so
+// later bindings can refer to earlier ones.
+func (p *parser) parseLet(start *Token) (*TokenTree, error) {
+	name := p.next()
+	if name == nil || name.Type != FUNC {
+		return nil, p.errorf(name, "expected variable name after let")
+	}
 
-	tree.Tokens = newTokens
-	return tree
+	if t := p.next(); t == nil || t.Type != OP || t.Value != "=" {
+		return nil, p.errorf(t, "expected = after %s", name.Value)
+	}
+
+	value, err := p.parseExpression(precLowest)
+	if err != nil {
+		return nil, err
+	}
+
+	p.vars = append(p.vars, name.Value)
+	defer func() {
+		p.vars = p.vars[:len(p.vars)-1]
+	}()
+
+	var body *TokenTree
+	t := p.next()
+	switch {
+	case t != nil && t.Type == NEXT:
+		body, err = p.parseLet(t)
+	case t != nil && t.Type == RESERVED && t.Value == "in":
+		body, err = p.parseExpression(precLowest)
+	default:
+		return nil, p.errorf(t, "expected in after let %s", name.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newTree(start.Pos, LET, name.Value, value, body), nil
 }
 
-func split(tree *TokenTree, TokenType int, Values []string) *TokenTree {
-	var nextTokens []*TokenTree
+// parseArray parses an array literal. The elements become the children of
+// the ARRAY node.
+func (p *parser) parseArray(start *Token) (*TokenTree, error) {
+	tree := newTree(start.Pos, ARRAY, nil)
+
+	if n := p.peek(); n != nil && n.Type == K_END {
+		p.next()
+		return tree, nil
+	}
 
-	popTokens := make([]*TokenTree, len(tree.Tokens))
+	for {
+		elem, err := p.parseExpression(precLowest)
+		if err != nil {
+			return nil, err
+		}
+		appendTree(tree, elem)
 
-	if len(tree.Tokens) > 0 {
-		for i, t := range tree.Tokens {
-			tree.Tokens[i] = split(t, TokenType, Values)
+		n := p.next()
+		if n == nil {
+			return nil, p.errorf(n, "unbalanced () or []")
+		}
+		switch n.Type {
+		case NEXT:
+		case K_END:
+			return tree, nil
+		default:
+			return nil, p.unexpected(n)
 		}
 	}
+}
 
-	copy(popTokens, tree.Tokens)
+// parseObject parses an object literal. The children of the OBJECT node
+// alternate between key and value. A key is a quoted string, a bare word or
+// a parenthesized expression that is computed when the object is built.
+func (p *parser) parseObject(start *Token) (*TokenTree, error) {
+	tree := newTree(start.Pos, OBJECT, nil)
 
-	for len(popTokens) > 2 {
-		prev := popTokens[0]
-		curr := popTokens[1]
-		next := popTokens[2]
+	if n := p.peek(); n != nil && n.Type == O_END {
+		p.next()
+		return tree, nil
+	}
 
-		if curr.Type == TokenType && inStringSlice(Values, curr.Value.(string)) {
-			prev.Parent = curr
-			next.Parent = curr
-			curr.Tokens = append(curr.Tokens, prev, next)
-			popTokens = popTokens[2:]
-			popTokens[0] = curr
-		} else {
-			nextTokens = append(nextTokens, popTokens[0])
-			popTokens = popTokens[1:]
+	for {
+		var key *TokenTree
+		t := p.next()
+		switch {
+		case t == nil:
+			return nil, p.errorf(t, "unbalanced {}")
+		case t.Type == D_STR, t.Type == S_STR:
+			key = newTree(t.Pos, D_STR, t.Value[1:len(t.Value)-1])
+		case t.Type == RESERVED:
+			key = newTree(t.Pos, D_STR, t.Value)
+		case t.Type == Q_START:
+			var err error
+			key, err = p.parseExpression(precLowest)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(Q_END); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.errorf(t, "invalid object key: %s", t.Value)
+		}
+
+		if err := p.expect(COLON); err != nil {
+			return nil, err
 		}
-	}
 
-	nextTokens = append(nextTokens, popTokens...)
+		value, err := p.parseExpression(precLowest)
+		if err != nil {
+			return nil, err
+		}
+		appendTree(tree, key)
+		appendTree(tree, value)
 
-	tree.Tokens = nextTokens
+		n := p.next()
+		if n == nil {
+			return nil, p.errorf(n, "unbalanced {}")
+		}
+		switch n.Type {
+		case NEXT:
+		case O_END:
+			return tree, nil
+		default:
+			return nil, p.unexpected(n)
+		}
+	}
+}
 
-	return tree
+// parseKey parses a key followed by any number of .key, [expr] and []
+// accessors. Each accessor becomes a child of the KEY node.
+func (p *parser) parseKey(t *Token) (*TokenTree, error) {
+	// remove '.' from key name
+	return p.parseAccessors(newTree(t.Pos, KEY, t.Value[1:]))
 }
 
-func inStringSlice(a []string, b string) bool {
-	for _, s := range a {
-		if s == b {
-			return true
+// parseAccessors appends .key, [expr], [] and [? predicate] accessors to a
+// KEY or VAR node.
+func (p *parser) parseAccessors(tree *TokenTree) (*TokenTree, error) {
+	for {
+		t := p.peek()
+		if t == nil {
+			return tree, nil
+		}
+
+		switch t.Type {
+		case KEY:
+			p.next()
+			appendTree(tree, newTree(t.Pos, KEY, t.Value[1:]))
+		case K_START:
+			p.next()
+			sub := newTree(t.Pos, K_START, nil)
+			if n := p.peek(); n != nil && n.Type == K_END {
+				p.next()
+				appendTree(tree, sub)
+				continue
+			}
+
+			// [? predicate] keeps the elements the predicate is true for
+			if n := p.peek(); n != nil && n.Type == TERNARY {
+				p.next()
+				sub.Type = FILTER
+			}
+
+			key, err := p.parseExpression(precLowest)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(K_END); err != nil {
+				return nil, err
+			}
+			appendTree(sub, key)
+			appendTree(tree, sub)
+		default:
+			return tree, nil
 		}
 	}
-	return false
 }
 
-func negative(tree *TokenTree) *TokenTree {
-	var negate *TokenTree
-	var newTokens []*TokenTree
-	var state int
-
-	for _, t := range tree.Tokens {
+// parseFunc parses a function call. The arguments become the children of
+// the FUNC node.
+func (p *parser) parseFunc(t *Token) (*TokenTree, error) {
+	tree := newTree(t.Pos, FUNC, t.Value)
 
-		// not entirely sure this case is correct
-		if t.Type == OP && t.Value == "-" && state != CONST && state != KEY && state != Q_START {
-			negate = t
-			newTokens = append(newTokens, t)
-			continue
+	if n := p.peek(); n == nil || n.Type != Q_START {
+		// without parentheses a name bound by let is a variable,
+		// otherwise it is a call with no arguments
+		if p.bound(t.Value) {
+			return p.parseAccessors(newTree(t.Pos, VAR, t.Value))
 		}
+		return tree, nil
+	}
+	p.next()
 
-		if negate != nil {
-			negate.Tokens = append(negate.Tokens, t)
-			negate = nil
-		} else {
-			t.Parent = negate
-			newTokens = append(newTokens, t)
+	if n := p.peek(); n != nil && n.Type == Q_END {
+		p.next()
+		return tree, nil
+	}
+
+	// variables the function binds inside its expression arguments
+	var implicit []string
+	if f := p.env.lookup(t.Value); f != nil {
+		implicit = f.Vars
+	}
+	p.vars = append(p.vars, implicit...)
+	defer func() {
+		p.vars = p.vars[:len(p.vars)-len(implicit)]
+	}()
+
+	for {
+		arg, err := p.parseArgument()
+		if err != nil {
+			return nil, err
 		}
+		appendTree(tree, arg)
 
-		state = t.Type
+		n := p.next()
+		if n == nil {
+			return nil, p.errorf(n, "unbalanced () or []")
+		}
+		switch n.Type {
+		case NEXT:
+		case Q_END:
+			return tree, nil
+		default:
+			return nil, p.unexpected(n)
+		}
+	}
+}
 
-		if len(t.Tokens) > 0 {
-			t = negative(t)
+// parseArgument parses a function argument, which is either an expression
+// or a lambda of the form $x -> expression.
+func (p *parser) parseArgument() (*TokenTree, error) {
+	if p.pos+1 < len(p.tokens) {
+		name, arrow := p.tokens[p.pos], p.tokens[p.pos+1]
+		if name.Type == FUNC && arrow.Type == OP && arrow.Value == "->" {
+			p.pos += 2
+			p.vars = append(p.vars, name.Value)
+			body, err := p.parseExpression(precLowest)
+			p.vars = p.vars[:len(p.vars)-1]
+			if err != nil {
+				return nil, err
+			}
+			return newTree(name.Pos, LAMBDA, name.Value, body), nil
 		}
 	}
 
-	tree.Tokens = newTokens
-	return tree
+	return p.parseExpression(precLowest)
 }
 
+// Parser builds a token tree from the output of Lexer. The root of the tree
+// has no type and holds the parsed expression as its only child.
 func Parser(tokens []*Token) (*TokenTree, error) {
+	return parse(tokens, globalEnv)
+}
 
-	tree, err := buildTree(tokens)
-	if err != nil {
-		return nil, err
+func parse(tokens []*Token, env *Env) (*TokenTree, error) {
+	p := &parser{tokens: tokens, env: env}
+	tree := &TokenTree{}
+
+	if len(tokens) == 0 {
+		return tree, nil
 	}
 
-	tree = not(tree)
-	tree = negative(tree)
+	last := tokens[len(tokens)-1]
+	p.end = last.Pos.advance(last.Value)
+	tree.query = last.query
 
-	tree = split(tree, OP, []string{"&&", "||"})
-	tree = split(tree, OP, []string{"*", "/"})
-	tree = split(tree, OP, []string{"+", "-"})
-	tree = split(tree, OP, []string{"==", ">=", ">", "<", "<=", "!="})
+	expr, err := p.parseExpression(precLowest)
+	if err != nil {
+		return nil, tree.located(err)
+	}
+
+	if t := p.peek(); t != nil {
+		return nil, tree.located(p.unexpected(t))
+	}
 
+	appendTree(tree, expr)
 	return tree, nil
 }
 
@@ -576,28 +1000,234 @@ var opFuncsNil = map[string]func(interface{}, interface{}) interface{}{
 		}
 
 		// comparing objects is a horrible condition and should be avoided
-		return reflect.DeepEqual(a, b)
+		return equalValues(a, b)
 	},
 	"!=": func(a interface{}, b interface{}) interface{} {
-		return a != b
+		// arrays and objects cannot be compared with !=
+		return !equalValues(a, b)
 	},
 }
 
-var nullaryFuncs = map[string]func() (interface{}, error){
-	"$now": func() (interface{}, error) {
-		return float64(time.Now().UnixNano() / 1000 / 1000), nil
-	},
+// operator holds the implementations of a binary operator for each type of
+// left operand, so that they can be looked up once per operator rather than
+// once per evaluation.
+type operator struct {
+	name  string
+	float func(float64, float64) interface{}
+	// integer is the exact implementation for two integers. It returns
+	// nil if the result is not an integer, and float is used instead.
+	integer func(*big.Int, *big.Int) interface{}
+	str     func(string, string) interface{}
+	boolean func(bool, bool) interface{}
+	other   func(interface{}, interface{}) interface{}
 }
 
-var unaryFuncs = map[string]func(interface{}) (interface{}, error){
-	"$sum": func(val interface{}) (interface{}, error) {
-		valsArray, ok := val.([]interface{})
+var binaryOperators = func() map[string]*operator {
+	ops := map[string]*operator{}
+	for op := range binaryPrecedence {
+		ops[op] = &operator{
+			name:    op,
+			float:   opFuncsFloat[op],
+			integer: opFuncsInt[op],
+			str:     opFuncsString[op],
+			boolean: opFuncsBool[op],
+			other:   opFuncsNil[op],
+		}
+	}
+	return ops
+}()
+
+func lookupOperator(name string) *operator {
+	if op, ok := binaryOperators[name]; ok {
+		return op
+	}
+	// an operator with no implementations fails for every type
+	return &operator{name: name}
+}
+
+// applyOperator applies a binary operator to the values of both sides of t
+func applyOperator(t *TokenTree, op *operator, a, b interface{}) (interface{}, error) {
+	// need to do comparisons for falsy-null || X
+	// as well as != and ==
+	switch ta := a.(type) {
+	case float64:
+		bf, ok := b.(float64)
+		if !ok {
+			return applyNumberOperator(t, op, a, b)
+		}
+
+		if op.float == nil {
+			return nil, typeError(t, a, "invalid operator for type: %s, %s", op.name, reflect.TypeOf(a))
+		}
+
+		r := op.float(ta, bf)
+		// only a float64 result this large may have lost integer
+		// precision
+		if f, ok := r.(float64); ok && op.integer != nil && !(f > -maxExact && f < maxExact) &&
+			isExactFloat(ta) && isExactFloat(bf) {
+			return numberOperator(op, a, b), nil
+		}
+		return r, nil
+	case int64, *big.Int, json.Number:
+		return applyNumberOperator(t, op, a, b)
+	case string:
+		bs, ok := b.(string)
+		if !ok && op.name == "!=" {
+			return true, nil
+		} else if !ok && op.name == "==" {
+			return false, nil
+		} else if !ok {
+			return nil, typeError(t, b, "cannot compare types: %s, %s", reflect.TypeOf(a), reflect.TypeOf(b))
+		}
+
+		if op.str == nil {
+			return nil, typeError(t, a, "invalid operator for type: %s, %s", op.name, reflect.TypeOf(a))
+		}
+
+		return op.str(ta, bs), nil
+	case bool:
+		bb, ok := b.(bool)
+		if !ok && op.name == "!=" {
+			return true, nil
+		} else if !ok && op.name == "==" {
+			return false, nil
+		} else if !ok {
+			return nil, typeError(t, b, "cannot compare types: %s, %s", reflect.TypeOf(a), reflect.TypeOf(b))
+		}
+
+		if op.boolean == nil {
+			return nil, typeError(t, a, "invalid operator for type: %s, %s", op.name, reflect.TypeOf(a))
+		}
+
+		return op.boolean(ta, bb), nil
+	default:
+		if op.other == nil {
+			return nil, typeError(t, a, "invalid operator for type: %s, %s", op.name, reflect.TypeOf(a))
+		}
+
+		return op.other(a, b), nil
+	}
+}
+
+// applyNumberOperator applies a binary operator to a number a and any b
+func applyNumberOperator(t *TokenTree, op *operator, a, b interface{}) (interface{}, error) {
+	na, ok := number(a)
+	if !ok {
+		return nil, typeError(t, a, "invalid number: %v", a)
+	}
+
+	nb, ok := number(b)
+	if !ok && op.name == "!=" {
+		return true, nil
+	} else if !ok && op.name == "==" {
+		return false, nil
+	} else if !ok {
+		return nil, typeError(t, b, "cannot compare types: %s, %s", reflect.TypeOf(a), reflect.TypeOf(b))
+	}
+
+	r := numberOperator(op, na, nb)
+	if r == nil {
+		return nil, typeError(t, a, "invalid operator for type: %s, %s", op.name, reflect.TypeOf(a))
+	}
+	return r, nil
+}
+
+// shortCircuit reports whether the left side a of && or || decides the
+// result, which is then a itself.
+func shortCircuit(t *TokenTree, op string, a interface{}) (bool, error) {
+	ab, ok := a.(bool)
+	if !ok {
+		return false, typeError(t, a, "invalid operator for type: %s, %s", op, reflect.TypeOf(a))
+	}
+	return ab == (op == "||"), nil
+}
+
+// unaryOperator applies - or ! to the value of the operand of t
+func unaryOperator(t *TokenTree, op string, v interface{}) (interface{}, error) {
+	switch op {
+	case "-":
+		n, ok := number(v)
+		if !ok {
+			return nil, typeError(t, v, "cannot use - operator on non-number type")
+		}
+
+		if f, ok := n.(float64); ok {
+			return -1 * f, nil
+		}
+		i, _ := toInt(n)
+		return normalizeInt(new(big.Int).Neg(i)), nil
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, typeError(t, v, "cannot use ! operator on non-bool type")
+		}
+
+		return !b, nil
+	}
+	return nil, nil
+}
+
+// Truthy converts a result to a bool by the rules of $~bool. null, false,
+// NaN, numbers that are not positive, empty strings and empty arrays are
+// false; everything else is true.
+func Truthy(val interface{}) bool {
+	if n, ok := number(val); ok {
+		val = n
+	}
+
+	switch v := val.(type) {
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return true
+	case float64:
+		return v > 0
+	case int64:
+		return v > 0
+	case *big.Int:
+		return v.Sign() > 0
+	case string:
+		return len(v) > 0
+	case bool:
+		return v
+	}
+	return false
+}
+
+var nullaryFuncs = map[string]func() (interface{}, error){
+	"$now": func() (interface{}, error) {
+		return float64(time.Now().UnixNano() / 1000 / 1000), nil
+	},
+}
+
+var unaryFuncs = map[string]func(interface{}) (interface{}, error){
+	"$sum": func(val interface{}) (interface{}, error) {
+		valsArray, ok := val.([]interface{})
 		if !ok {
 			return nil, nil
 		}
+		// sum float64s until the sum may no longer be exact
 		sum := 0.0
-		for _, i := range valsArray {
-			sum += i.(float64)
+		var exact interface{}
+		for i, e := range valsArray {
+			if f, ok := e.(float64); ok && exact == nil {
+				if s := sum + f; s > -maxExact && s < maxExact {
+					sum = s
+					continue
+				}
+			}
+
+			n, ok := number(e)
+			if !ok {
+				return nil, argError(e, "element %d is not a number, got: %s", i, reflect.TypeOf(e))
+			}
+			if exact == nil {
+				exact = sum
+			}
+			exact = numberOperator(binaryOperators["+"], exact, n)
+		}
+		if exact != nil {
+			return exact, nil
 		}
 		return sum, nil
 	},
@@ -607,9 +1237,21 @@ var unaryFuncs = map[string]func(interface{}) (interface{}, error){
 			return nil, nil
 		}
 
-		min := valsArray[0].(float64)
-		for i := 1; i < len(valsArray); i++ {
-			min = math.Min(min, valsArray[i].(float64))
+		if len(valsArray) == 0 {
+			return nil, nil
+		}
+
+		var min interface{}
+		for i, e := range valsArray {
+			n, ok := number(e)
+			if !ok {
+				return nil, argError(e, "element %d is not a number, got: %s", i, reflect.TypeOf(e))
+			}
+			if i == 0 {
+				min = n
+			} else {
+				min = extremeNumber(min, n, math.Min, -1)
+			}
 		}
 		return min, nil
 	},
@@ -619,9 +1261,21 @@ var unaryFuncs = map[string]func(interface{}) (interface{}, error){
 			return nil, nil
 		}
 
-		max := valsArray[0].(float64)
-		for i := 1; i < len(valsArray); i++ {
-			max = math.Max(max, valsArray[i].(float64))
+		if len(valsArray) == 0 {
+			return nil, nil
+		}
+
+		var max interface{}
+		for i, e := range valsArray {
+			n, ok := number(e)
+			if !ok {
+				return nil, argError(e, "element %d is not a number, got: %s", i, reflect.TypeOf(e))
+			}
+			if i == 0 {
+				max = n
+			} else {
+				max = extremeNumber(max, n, math.Max, 1)
+			}
 		}
 		return max, nil
 	},
@@ -634,27 +1288,34 @@ var unaryFuncs = map[string]func(interface{}) (interface{}, error){
 		return float64(len(valsArray)), nil
 	},
 	"$sqrt": func(val interface{}) (interface{}, error) {
-		f, ok := val.(float64)
-		if !ok || f < 0 {
+		n, ok := number(val)
+		if !ok || toFloat(n) < 0 {
 			return nil, nil
 		}
 
-		return math.Sqrt(f), nil
+		return math.Sqrt(toFloat(n)), nil
 	},
 	"$abs": func(val interface{}) (interface{}, error) {
-		f, ok := val.(float64)
+		n, ok := number(val)
 		if !ok {
 			return nil, nil
 		}
-		return math.Abs(f), nil
+		if f, ok := n.(float64); ok {
+			return math.Abs(f), nil
+		}
+		i, _ := toInt(n)
+		return normalizeInt(new(big.Int).Abs(i)), nil
 	},
 	"$floor": func(val interface{}) (interface{}, error) {
-		f, ok := val.(float64)
+		n, ok := number(val)
 		if !ok {
 			return nil, nil
 		}
-
-		return math.Floor(f), nil
+		if f, ok := n.(float64); ok {
+			return math.Floor(f), nil
+		}
+		// exact numbers are integers
+		return n, nil
 	},
 	"$keys": func(val interface{}) (interface{}, error) {
 		var keyList []interface{}
@@ -670,9 +1331,17 @@ var unaryFuncs = map[string]func(interface{}) (interface{}, error){
 		return keyList, nil
 	},
 	"$str": func(val interface{}) (interface{}, error) {
+		if n, ok := number(val); ok {
+			val = n
+		}
+
 		switch v := val.(type) {
 		case float64:
 			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case *big.Int:
+			return v.String(), nil
 		case bool:
 			if v {
 				return "true", nil
@@ -689,42 +1358,22 @@ var unaryFuncs = map[string]func(interface{}) (interface{}, error){
 		return "", nil
 	},
 	"$num": func(val interface{}) (interface{}, error) {
+		if n, ok := number(val); ok {
+			return n, nil
+		}
+
 		switch v := val.(type) {
-		case float64:
-			return v, nil
 		case string:
-			return strconv.ParseFloat(v, 64)
+			return parseNumber(v)
 		case bool:
 			if v {
-				return 1, nil
+				return 1.0, nil
 			}
 		}
 		return 0.0, nil
 	},
 	"$~bool": func(val interface{}) (interface{}, error) {
-		switch v := val.(type) {
-		case []interface{}:
-			if len(v) > 0 {
-				return true, nil
-			}
-		case map[string]interface{}:
-			return true, nil
-		case float64:
-			if math.IsNaN(v) {
-				return false, nil
-			}
-
-			if v > 0 {
-				return true, nil
-			}
-		case string:
-			if len(v) > 0 {
-				return true, nil
-			}
-		case bool:
-			return v, nil
-		}
-		return false, nil
+		return Truthy(val), nil
 	},
 	"$bool": func(val interface{}) (interface{}, error) {
 		switch v := val.(type) {
@@ -760,24 +1409,25 @@ var binaryFuncs = map[string]func(interface{}, interface{}) (interface{}, error)
 			return nil, nil
 		}
 
-		t, ok := b.(float64)
+		n, ok := number(b)
 		if !ok {
 			return nil, nil
 		}
+		t := toFloat(n)
 
 		return time.Unix(0, int64(time.Duration(t)*time.Millisecond)).Format(layout), nil
 	},
 	"$pow": func(a interface{}, b interface{}) (interface{}, error) {
-		fa, ok := a.(float64)
+		na, ok := number(a)
 		if !ok {
 			return nil, nil
 		}
-		fb, ok := b.(float64)
+		nb, ok := number(b)
 		if !ok {
 			return nil, nil
 		}
 
-		return math.Pow(fa, fb), nil
+		return math.Pow(toFloat(na), toFloat(nb)), nil
 	},
 	"$exists": func(a interface{}, b interface{}) (interface{}, error) {
 		sb, ok := b.(string)
@@ -830,19 +1480,19 @@ var binaryFuncs = map[string]func(interface{}, interface{}) (interface{}, error)
 		for _, e := range s {
 			switch c := e.(type) {
 			case string:
-				if c == b.(string) {
+				if bs, ok := b.(string); ok && c == bs {
 					return true, nil
 				}
-			case float64:
-				if c == b.(float64) {
+			case float64, int64, *big.Int, json.Number:
+				if _, ok := number(b); ok && equalValues(c, b) {
 					return true, nil
 				}
 			case bool:
-				if c == b.(bool) {
+				if bb, ok := b.(bool); ok && c == bb {
 					return true, nil
 				}
-			default:
-				if a == nil && b == nil {
+			case nil:
+				if b == nil {
 					return true, nil
 				}
 			}
@@ -851,265 +1501,566 @@ var binaryFuncs = map[string]func(interface{}, interface{}) (interface{}, error)
 	},
 }
 
-func getKeyValues(t *TokenTree, input BMsg) (interface{}, error) {
-	s, ok := t.Value.(string)
+// Lambda is a function argument that is evaluated lazily, once for every
+// value the function applies it to. A Lambda must only be called before the
+// function it was passed to returns, from the same goroutine.
+type Lambda struct {
+	tree  *TokenTree
+	param string
+	vars  []string
+	sc    *scope
+	// set instead of sc when the lambda was compiled to bytecode
+	m  *vm
+	fn *lambdaCode
+}
 
-	if ok && len(s) > 0 {
-		inputMap, ok := input.(map[string]interface{})
-		if !ok {
-			return nil, errors.New("could not assert to map")
+// Call evaluates the argument with v as . and binds values to the
+// variables the function declares, in order. If the argument was written as
+// $x -> expression, v is also bound to $x.
+func (l *Lambda) Call(v interface{}, values ...interface{}) (interface{}, error) {
+	if l.fn != nil {
+		return l.m.call(l.fn, v, values)
+	}
+
+	sc := l.sc
+	for i, name := range l.vars {
+		if i < len(values) {
+			sc = sc.bind(name, values[i])
 		}
+	}
+	if l.param != "" {
+		sc = sc.bind(l.param, v)
+	}
+	return eval(l.tree, v, sc)
+}
 
-		input = inputMap[s]
+// callPredicate calls a lambda that must return a bool
+func callPredicate(f *Lambda, v interface{}) (bool, error) {
+	r, err := f.Call(v)
+	if err != nil {
+		return false, err
 	}
 
-	var output []interface{}
-	output = append(output, input)
-	var accessed bool // this needs to be figured out!
+	b, ok := r.(bool)
+	if !ok {
+		return false, typeError(f.tree, r, "predicate must return a bool, got: %s", reflect.TypeOf(r))
+	}
+	return b, nil
+}
 
-	for _, sub := range t.Tokens {
-		switch sub.Type {
-		case K_START:
-			switch c := sub.Value.(type) {
-			case string:
-				for j, _ := range output {
-					outputMap, ok := output[j].(map[string]interface{})
-					if !ok {
-						return nil, errors.New("could not assert to map")
-					}
+// exprFuncs returns the built-in functions that take expression arguments.
+// It is a function rather than a map because the functions evaluate their
+// arguments through eval, which looks functions up in turn.
+func exprFuncs() map[string]*Func {
+	return map[string]*Func{
+		"$map": &Func{
+			Params: []Type{TypeAny, TypeExpr},
+			Fn: func(args []interface{}) (interface{}, error) {
+				arr, ok := args[0].([]interface{})
+				if !ok {
+					return nil, nil
+				}
+				f := args[1].(*Lambda)
 
-					output[j] = outputMap[c]
+				out := make([]interface{}, len(arr))
+				for i, e := range arr {
+					r, err := f.Call(e)
+					if err != nil {
+						return nil, err
+					}
+					out[i] = r
 				}
-			case float64:
-				for j, _ := range output {
-					outputSlice, ok := output[j].([]interface{})
-					if !ok {
-						return nil, errors.New("could not assert to slice")
+				return out, nil
+			},
+		},
+		"$filter": &Func{
+			Params: []Type{TypeAny, TypeExpr},
+			Fn: func(args []interface{}) (interface{}, error) {
+				arr, ok := args[0].([]interface{})
+				if !ok {
+					return nil, nil
+				}
+				f := args[1].(*Lambda)
+
+				out := []interface{}{}
+				for _, e := range arr {
+					keep, err := callPredicate(f, e)
+					if err != nil {
+						return nil, err
 					}
-					sliceIndex := int(c)
-					if c < 0 || sliceIndex >= len(outputSlice) {
-						output[j] = nil
-					} else {
-						output[j] = outputSlice[sliceIndex]
+					if keep {
+						out = append(out, e)
 					}
 				}
-			default:
-				accessed = true
-				var newOutput []interface{}
-				for j, _ := range output {
-					arr, ok := output[j].([]interface{})
-					if !ok {
-						return nil, errors.New("could not assert to slice")
+				return out, nil
+			},
+		},
+		"$reduce": &Func{
+			Params: []Type{TypeAny, TypeAny, TypeExpr},
+			Vars:   []string{"$acc"},
+			Fn: func(args []interface{}) (interface{}, error) {
+				arr, ok := args[0].([]interface{})
+				if !ok {
+					return nil, nil
+				}
+				acc := args[1]
+				f := args[2].(*Lambda)
+
+				for _, e := range arr {
+					r, err := f.Call(e, acc)
+					if err != nil {
+						return nil, err
 					}
-					for _, e := range arr {
-						newOutput = append(newOutput, e)
+					acc = r
+				}
+				return acc, nil
+			},
+		},
+		"$any": &Func{
+			Params: []Type{TypeAny, TypeExpr},
+			Fn: func(args []interface{}) (interface{}, error) {
+				arr, ok := args[0].([]interface{})
+				if !ok {
+					return nil, nil
+				}
+				f := args[1].(*Lambda)
+
+				for _, e := range arr {
+					b, err := callPredicate(f, e)
+					if err != nil {
+						return nil, err
+					}
+					if b {
+						return true, nil
 					}
 				}
-				output = newOutput
-			}
-		case KEY:
-			for j, _ := range output {
-				outputMap, ok := output[j].(map[string]interface{})
+				return false, nil
+			},
+		},
+		"$all": &Func{
+			Params: []Type{TypeAny, TypeExpr},
+			Fn: func(args []interface{}) (interface{}, error) {
+				arr, ok := args[0].([]interface{})
 				if !ok {
-					errors.New("could not assert to map")
+					return nil, nil
 				}
+				f := args[1].(*Lambda)
 
-				subValue, ok := sub.Value.(string)
+				for _, e := range arr {
+					b, err := callPredicate(f, e)
+					if err != nil {
+						return nil, err
+					}
+					if !b {
+						return false, nil
+					}
+				}
+				return true, nil
+			},
+		},
+		"$count": &Func{
+			Params: []Type{TypeAny, TypeExpr},
+			Fn: func(args []interface{}) (interface{}, error) {
+				arr, ok := args[0].([]interface{})
 				if !ok {
-					errors.New("invalid key for map")
+					return nil, nil
 				}
-				output[j] = outputMap[subValue]
-			}
+				f := args[1].(*Lambda)
+
+				count := 0.0
+				for _, e := range arr {
+					b, err := callPredicate(f, e)
+					if err != nil {
+						return nil, err
+					}
+					if b {
+						count++
+					}
+				}
+				return count, nil
+			},
+		},
+	}
+}
+
+// globals holds the state shared by every scope of one evaluation
+type globals struct {
+	// external @variables
+	vars map[string]interface{}
+	// functions resolved when the expression was compiled. If nil,
+	// functions are looked up in the global registry.
+	funcs map[string]*Func
+}
+
+// scope holds the variables bound by let expressions. A scope is never
+// modified; binding a variable returns a new scope pointing at its parent.
+type scope struct {
+	name   string
+	value  interface{}
+	parent *scope
+	g      *globals
+}
+
+func (sc *scope) bind(name string, value interface{}) *scope {
+	n := &scope{
+		name:   name,
+		value:  value,
+		parent: sc,
+	}
+	if sc != nil {
+		n.g = sc.g
+	}
+	return n
+}
+
+func (sc *scope) lookupExt(name string) (interface{}, bool) {
+	if sc == nil || sc.g == nil {
+		return nil, false
+	}
+	v, ok := sc.g.vars[name]
+	return v, ok
+}
+
+func (sc *scope) lookupFunc(name string) *Func {
+	if sc != nil && sc.g != nil && sc.g.funcs != nil {
+		return sc.g.funcs[name]
+	}
+	return globalEnv.lookup(name)
+}
+
+func (sc *scope) lookup(name string) (interface{}, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if sc.name == name {
+			return sc.value, true
 		}
 	}
+	return nil, false
+}
 
-	if len(output) == 1 && !accessed {
-		return output[0], nil
+// resolveKeys evaluates the bracket keys of a KEY or VAR node. The keys are
+// returned in a separate slice so that the tree is never modified and can be
+// shared between goroutines.
+func resolveKeys(t *TokenTree, msg BMsg, sc *scope) ([]interface{}, error) {
+	keys := make([]interface{}, len(t.Tokens))
+	for i, sub := range t.Tokens {
+		switch {
+		case sub.Type == KEY:
+			keys[i] = sub.Value
+		case sub.Type == K_START && len(sub.Tokens) > 0:
+			key, err := eval(sub.Tokens[0], msg, sc)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = key
+		}
 	}
+	return keys, nil
+}
 
-	return output, nil
+// filterer evaluates the predicate of the FILTER accessor at index i of a
+// KEY, VAR or EXT node with e as .
+type filterer interface {
+	filter(sub *TokenTree, i int, e interface{}) (interface{}, error)
 }
 
-func Eval(t *TokenTree, msg BMsg) (interface{}, error) {
-	var tokenVal string
+func (sc *scope) filter(sub *TokenTree, i int, e interface{}) (interface{}, error) {
+	return eval(sub.Tokens[0], e, sc)
+}
 
-	switch t.Type {
-	case OP, KEY, FUNC:
-		_, ok := t.Value.(string)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("bad operation, key, or function: %s", t.Value))
+func getKeyValues(t *TokenTree, keys []interface{}, input BMsg, f filterer) (interface{}, error) {
+	s, ok := t.Value.(string)
+
+	// the message may be any Go value, see toValue
+	input = orNil(input)
+
+	if ok && len(s) > 0 && t.Type == KEY {
+		var err error
+		input, err = memberOf(t, input, s)
+		if err != nil {
+			return nil, err
 		}
-		tokenVal = t.Value.(string)
 	}
 
-	switch t.Type {
-	case OP:
-		if len(t.Tokens) == 1 {
-			switch tokenVal {
-			case "-":
-				r, err := Eval(t.Tokens[0], msg)
+	var output []interface{}
+	output = append(output, input)
+	var accessed bool // this needs to be figured out!
+
+	for i, sub := range t.Tokens {
+		// a key of [] has no expression and fans out over the array
+		if sub.Type == K_START && len(sub.Tokens) == 0 {
+			accessed = true
+			var newOutput []interface{}
+			for j, _ := range output {
+				arr, err := elementsOf(sub, output[j])
 				if err != nil {
 					return nil, err
 				}
-
-				f, ok := r.(float64)
-				if !ok {
-					return nil, errors.New("cannot use - operator on non-number type")
+				for _, e := range arr {
+					newOutput = append(newOutput, orNil(e))
 				}
+			}
+			output = newOutput
+			continue
+		}
 
-				return -1 * f, nil
-
-			case "!":
-				r, err := Eval(t.Tokens[0], msg)
+		// a filter fans out over the array like [] but only keeps the
+		// elements for which the predicate, evaluated with the element
+		// as ., is true
+		if sub.Type == FILTER {
+			accessed = true
+			newOutput := []interface{}{}
+			for j, _ := range output {
+				arr, err := elementsOf(sub, output[j])
 				if err != nil {
 					return nil, err
 				}
+				for _, e := range arr {
+					e = orNil(e)
+					r, err := f.filter(sub, i, e)
+					if err != nil {
+						return nil, err
+					}
 
-				b, ok := r.(bool)
-				if !ok {
-					return nil, errors.New("cannot use ! operator on non-bool type")
+					keep, ok := r.(bool)
+					if !ok {
+						return nil, typeError(sub.Tokens[0], r, "filter predicate must be a bool, got: %s", reflect.TypeOf(r))
+					}
+					if keep {
+						newOutput = append(newOutput, e)
+					}
 				}
-
-				return !b, nil
 			}
-			break
+			output = newOutput
+			continue
 		}
-		if len(t.Tokens) == 2 {
-			a, err := Eval(t.Tokens[0], msg)
-			if err != nil {
-				return nil, err
-			}
 
-			b, err := Eval(t.Tokens[1], msg)
-			if err != nil {
-				return nil, err
-			}
-			// need to do comparisons for falsy-null || X
-			// as well as != and ==
+		key := keys[i]
+		if n, ok := number(key); ok {
+			// an exact integer is too large to be in range
+			key = toFloat(n)
+		}
 
-			switch ta := a.(type) {
-			case float64:
-				bf, ok := b.(float64)
-				if !ok && tokenVal == "!=" {
-					return true, nil
-				} else if !ok && tokenVal == "==" {
-					return false, nil
-				} else if !ok {
-					return nil, errors.New(fmt.Sprintf("cannot compare types: %s, %s", reflect.TypeOf(a), reflect.TypeOf(b)))
+		switch c := key.(type) {
+		case string:
+			for j, _ := range output {
+				if output[j] == nil {
+					continue
 				}
 
-				_, ok = opFuncsFloat[tokenVal]
-				if !ok {
-					return nil, errors.New(fmt.Sprintf("invalid operator for type: %s, %s", tokenVal, reflect.TypeOf(a)))
+				v, err := keyOf(sub, output[j], c)
+				if err != nil {
+					return nil, err
 				}
-
-				return opFuncsFloat[tokenVal](ta, bf), nil
-			case string:
-				bs, ok := b.(string)
-				if !ok && tokenVal == "!=" {
-					return true, nil
-				} else if !ok && tokenVal == "==" {
-					return false, nil
-				} else if !ok {
-					return nil, errors.New(fmt.Sprintf("cannot compare types: %s, %s", reflect.TypeOf(a), reflect.TypeOf(b)))
+				output[j] = v
+			}
+		case float64:
+			for j, _ := range output {
+				if output[j] == nil {
+					continue
 				}
 
-				_, ok = opFuncsString[tokenVal]
-				if !ok {
-					return nil, errors.New(fmt.Sprintf("invalid operator for type: %s, %s", tokenVal, reflect.TypeOf(a)))
+				v, err := indexOf(sub, output[j], c)
+				if err != nil {
+					return nil, err
 				}
+				output[j] = v
+			}
+		default:
+			return nil, typeError(sub, c, "invalid key type: %s", reflect.TypeOf(c))
+		}
+	}
 
-				return opFuncsString[tokenVal](ta, bs), nil
-			case bool:
-				bb, ok := b.(bool)
-				if !ok && tokenVal == "!=" {
-					return true, nil
-				} else if !ok && tokenVal == "==" {
-					return false, nil
-				} else if !ok {
-					return nil, errors.New(fmt.Sprintf("cannot compare types: %s, %s", reflect.TypeOf(a), reflect.TypeOf(b)))
-				}
+	if len(output) == 1 && !accessed {
+		return convertAt(t, output[0])
+	}
 
-				_, ok = opFuncsBool[tokenVal]
-				if !ok {
-					return nil, errors.New(fmt.Sprintf("invalid operator for type: %s, %s", tokenVal, reflect.TypeOf(a)))
-				}
+	for j, v := range output {
+		v, err := convertAt(t, v)
+		if err != nil {
+			return nil, err
+		}
+		output[j] = v
+	}
+	return output, nil
+}
 
-				return opFuncsBool[tokenVal](ta, bb), nil
-			default:
-				_, ok := opFuncsNil[tokenVal]
-				if !ok {
-					return nil, errors.New(fmt.Sprintf("invalid operator for type: %s, %s", tokenVal, reflect.TypeOf(a)))
+// Eval evaluates msg against a tree generated by Parser. Besides the types
+// given by json.Unmarshal, msg may hold structs, typed maps and slices,
+// integers and time.Time values, which are read by reflection as
+// json.Marshal would encode them. A time.Time is epoch milliseconds.
+func Eval(t *TokenTree, msg BMsg) (result interface{}, err error) {
+	defer recoverEval(&err)
+	result, err = eval(t, msg, nil)
+	return result, t.located(err)
+}
+
+// EvalWithVars is like Eval but binds the external variables referenced as
+// @name in the query. Like msg, vars may hold any Go values, see Eval.
+func EvalWithVars(t *TokenTree, msg BMsg, vars map[string]interface{}) (result interface{}, err error) {
+	defer recoverEval(&err)
+	result, err = eval(t, msg, &scope{g: &globals{vars: vars}})
+	return result, t.located(err)
+}
+
+func eval(t *TokenTree, msg BMsg, sc *scope) (interface{}, error) {
+	var tokenVal string
+
+	switch t.Type {
+	case OP, KEY, FUNC, VAR, LET, EXT, LAMBDA:
+		_, ok := t.Value.(string)
+		if !ok {
+			return nil, typeError(t, t.Value, "bad operation, key, or function: %s", t.Value)
+		}
+		tokenVal = t.Value.(string)
+	}
+
+	switch t.Type {
+	case OP:
+		if len(t.Tokens) == 1 {
+			r, err := eval(t.Tokens[0], msg, sc)
+			if err != nil {
+				return nil, err
+			}
+			return unaryOperator(t, tokenVal, r)
+		}
+		if len(t.Tokens) == 2 {
+			a, err := eval(t.Tokens[0], msg, sc)
+			if err != nil {
+				return nil, err
+			}
+
+			// the result of the left side of a pipe becomes . for the
+			// right side
+			if tokenVal == "|" {
+				return eval(t.Tokens[1], a, sc)
+			}
+
+			// the right side of && and || is only evaluated if the left
+			// side does not decide the result, so that a guard like
+			// $exists(., "a") && .a.b > 3 protects the right side
+			if tokenVal == "&&" || tokenVal == "||" {
+				decided, err := shortCircuit(t, tokenVal, a)
+				if err != nil || decided {
+					return a, err
 				}
+			}
 
-				return opFuncsNil[tokenVal](a, b), nil
+			b, err := eval(t.Tokens[1], msg, sc)
+			if err != nil {
+				return nil, err
 			}
+
+			return applyOperator(t, lookupOperator(tokenVal), a, b)
 		}
 	case S_STR, D_STR, CONST, RESERVED:
 		return t.Value, nil
-	case KEY:
-		input := msg
+	case COND:
+		// only the selected branch is evaluated
+		c, err := eval(t.Tokens[0], msg, sc)
+		if err != nil {
+			return nil, err
+		}
 
-		for _, sub := range t.Tokens {
-			if len(sub.Tokens) > 0 {
-				key, err := Eval(sub.Tokens[0], input)
-				if err != nil {
-					return nil, err
-				}
+		b, ok := c.(bool)
+		if !ok {
+			return nil, typeError(t, c, "condition must be a bool, got: %s", reflect.TypeOf(c))
+		}
 
-				switch key.(type) {
-				case string:
-					sub.Type = KEY
-				}
-				sub.Value = key
-				sub.Tokens = nil
-			}
+		if b {
+			return eval(t.Tokens[1], msg, sc)
+		}
+		return eval(t.Tokens[2], msg, sc)
+	case KEY:
+		keys, err := resolveKeys(t, msg, sc)
+		if err != nil {
+			return nil, err
+		}
+
+		return getKeyValues(t, keys, msg, sc)
+	case VAR:
+		value, ok := sc.lookup(tokenVal)
+		if !ok {
+			return nil, evalError(t, UndefinedError, "undefined variable: %s", tokenVal)
 		}
 
-		return getKeyValues(t, input)
-	case FUNC:
 		if len(t.Tokens) == 0 {
-			_, ok := nullaryFuncs[tokenVal]
-			if !ok {
-				return nil, errors.New(fmt.Sprintf("func does not exist or wrong num of arguments: %s", tokenVal))
+			return value, nil
+		}
+
+		keys, err := resolveKeys(t, msg, sc)
+		if err != nil {
+			return nil, err
+		}
+
+		return getKeyValues(t, keys, value, sc)
+	case ARRAY:
+		arr := make([]interface{}, len(t.Tokens))
+		for i, sub := range t.Tokens {
+			v, err := eval(sub, msg, sc)
+			if err != nil {
+				return nil, err
 			}
-			return nullaryFuncs[tokenVal]()
+			arr[i] = v
 		}
-		if len(t.Tokens) == 1 {
-			a, err := Eval(t.Tokens[0], msg)
+		return arr, nil
+	case OBJECT:
+		obj := make(map[string]interface{}, len(t.Tokens)/2)
+		for i := 0; i+1 < len(t.Tokens); i += 2 {
+			k, err := eval(t.Tokens[i], msg, sc)
 			if err != nil {
 				return nil, err
 			}
 
-			_, ok := unaryFuncs[tokenVal]
+			key, ok := k.(string)
 			if !ok {
-				return nil, errors.New(fmt.Sprintf("func does not exist or wrong num of arguments: %s", tokenVal))
+				return nil, typeError(t.Tokens[i], k, "object key must be a string, got: %s", reflect.TypeOf(k))
 			}
 
-			return unaryFuncs[tokenVal](a)
-		} else if len(t.Tokens) == 3 {
-
-			a, err := Eval(t.Tokens[0], msg)
+			v, err := eval(t.Tokens[i+1], msg, sc)
 			if err != nil {
 				return nil, err
 			}
+			obj[key] = v
+		}
+		return obj, nil
+	case EXT:
+		value, ok := sc.lookupExt(tokenVal)
+		if !ok {
+			return nil, evalError(t, UndefinedError, "undefined variable: @%s", tokenVal)
+		}
 
-			b, err := Eval(t.Tokens[2], msg)
-			if err != nil {
-				return nil, err
-			}
+		if len(t.Tokens) == 0 {
+			return convertAt(t, value)
+		}
 
-			_, ok := binaryFuncs[tokenVal]
-			if !ok {
-				return nil, errors.New(fmt.Sprintf("func does not exist or wrong num of arguments: %s", tokenVal))
-			}
+		keys, err := resolveKeys(t, msg, sc)
+		if err != nil {
+			return nil, err
+		}
+
+		return getKeyValues(t, keys, value, sc)
+	case LET:
+		value, err := eval(t.Tokens[0], msg, sc)
+		if err != nil {
+			return nil, err
+		}
 
-			return binaryFuncs[tokenVal](a, b)
+		return eval(t.Tokens[1], msg, sc.bind(tokenVal, value))
+	case LAMBDA:
+		return nil, evalError(t, TypeError, "%s -> can only be used as an argument to a function that takes an expression", tokenVal)
+	case FUNC:
+		f := sc.lookupFunc(tokenVal)
+		if f == nil {
+			return nil, evalError(t, UndefinedError, "func does not exist: %s", tokenVal)
 		}
-		return nil, errors.New(fmt.Sprintf("func does not exist or wrong num of arguments: %s", tokenVal))
+		if !f.acceptsArgs(len(t.Tokens)) {
+			return nil, evalError(t, ArityError, "wrong num of arguments for %s: %d", tokenVal, len(t.Tokens))
+		}
+
+		return callFunc(f, tokenVal, t, msg, sc)
 	default:
 		if len(t.Tokens) > 0 {
-			return Eval(t.Tokens[0], msg)
+			return eval(t.Tokens[0], msg, sc)
 		}
 	}
 
@@ -1118,7 +2069,7 @@ func Eval(t *TokenTree, msg BMsg) (interface{}, error) {
 
 func FmtTokens(tl []*Token) {
 	for _, t := range tl {
-		fmt.Printf("(" + IdentStr[t.Type] + " " + t.Value + ") ")
+		fmt.Printf("(%s %s) ", IdentStr[t.Type], t.Value)
 	}
 }
 
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errHelp is returned by parseArgs when help is asked for
+var errHelp = errors.New("help requested")
+
+// option is a command line flag followed by len(args) values
+type option struct {
+	name string
+	// short is an optional one letter alias, such as -c
+	short string
+	// args names the values that follow the flag in the help text
+	args []string
+	help string
+	set  func(vals []string) error
+}
+
+// isFlag reports whether arg is a flag rather than a query that starts with
+// a minus, like -.a or -1
+func isFlag(arg string) bool {
+	if strings.HasPrefix(arg, "--") {
+		return true
+	}
+	if len(arg) < 2 || arg[0] != '-' {
+		return false
+	}
+	c := arg[1]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// parseArgs sets the flags in args and returns the arguments that are not
+// flags. Everything after -- is not a flag. A flag that takes one value can
+// be given it as --name=value.
+func parseArgs(flags []*option, args []string) ([]string, error) {
+	byName := make(map[string]*option)
+	for _, f := range flags {
+		byName[f.name] = f
+		if f.short != "" {
+			byName[f.short] = f
+		}
+	}
+
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(rest, args[i+1:]...), nil
+		}
+		if !isFlag(arg) {
+			rest = append(rest, arg)
+			continue
+		}
+		if arg == "-h" || arg == "--help" {
+			return nil, errHelp
+		}
+
+		name, value := arg, ""
+		hasValue := false
+		if j := strings.Index(arg, "="); j > 0 && strings.HasPrefix(arg, "--") {
+			name, value, hasValue = arg[:j], arg[j+1:], true
+		}
+
+		f, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown flag: %s", name)
+		}
+
+		var vals []string
+		switch {
+		case hasValue && len(f.args) != 1:
+			return nil, fmt.Errorf("%s does not take a value", name)
+		case hasValue:
+			vals = []string{value}
+		case i+len(f.args) >= len(args):
+			return nil, fmt.Errorf("%s needs %s", name, strings.Join(f.args, " and "))
+		default:
+			vals = args[i+1 : i+1+len(f.args)]
+			i += len(f.args)
+		}
+
+		if err := f.set(vals); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return rest, nil
+}
+
+// printOptions writes the help text of each option, one per line
+func printOptions(w io.Writer, flags []*option) {
+	names := make([]string, len(flags))
+	width := 0
+	for i, f := range flags {
+		names[i] = f.name
+		if f.short != "" {
+			names[i] = f.short + ", " + f.name
+		}
+		for _, a := range f.args {
+			names[i] += " " + a
+		}
+		if len(names[i]) > width {
+			width = len(names[i])
+		}
+	}
+
+	for i, f := range flags {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, names[i], f.help)
+	}
+}
+
+// setTrue returns a set function that sets b
+func setTrue(b *bool) func([]string) error {
+	return func([]string) error {
+		*b = true
+		return nil
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsFlag(t *testing.T) {
+	for arg, expected := range map[string]bool{
+		"-c":       true,
+		"-e":       true,
+		"--raw":    true,
+		"--a=b":    true,
+		"--":       true,
+		"-.a":      false,
+		"-1":       false,
+		"-(.a)":    false,
+		"-$abs(1)": false,
+		"-":        false,
+		".a":       false,
+		"":         false,
+	} {
+		if isFlag(arg) != expected {
+			t.Errorf("%q: expected %v", arg, expected)
+		}
+	}
+}
+
+// testFlags returns a flag set that records what is set in got
+func testFlags(got map[string][]string) []*option {
+	record := func(name string) func([]string) error {
+		return func(vals []string) error {
+			got[name] = append([]string{}, vals...)
+			return nil
+		}
+	}
+	return []*option{
+		{name: "--compact", short: "-c", help: "one line", set: record("compact")},
+		{name: "--indent", args: []string{"n"}, help: "indent", set: func(vals []string) error {
+			if vals[0] == "bad" {
+				return errors.New("not a number")
+			}
+			got["indent"] = vals
+			return nil
+		}},
+		{name: "--arg", args: []string{"name", "value"}, help: "bind", set: record("arg")},
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		rest []string
+		set  map[string][]string
+		err  string
+	}{
+		{args: []string{".a"}, rest: []string{".a"}},
+		{args: []string{"-c", ".a", "f.json"}, rest: []string{".a", "f.json"}, set: map[string][]string{"compact": {}}},
+		{args: []string{".a", "--compact"}, rest: []string{".a"}, set: map[string][]string{"compact": {}}},
+		{args: []string{"--indent", "2", "."}, rest: []string{"."}, set: map[string][]string{"indent": {"2"}}},
+		{args: []string{"--indent=2", "."}, rest: []string{"."}, set: map[string][]string{"indent": {"2"}}},
+		{args: []string{"--indent=", "."}, rest: []string{"."}, set: map[string][]string{"indent": {""}}},
+		{args: []string{"--arg", "x", "-c", "@x"}, rest: []string{"@x"}, set: map[string][]string{"arg": {"x", "-c"}}},
+		{args: []string{"-.a"}, rest: []string{"-.a"}},
+		{args: []string{"-1", "-"}, rest: []string{"-1", "-"}},
+		{args: []string{"-c", "--", "-c", "--indent"}, rest: []string{"-c", "--indent"}, set: map[string][]string{"compact": {}}},
+		{args: []string{"-h"}, err: errHelp.Error()},
+		{args: []string{".a", "--help"}, err: errHelp.Error()},
+		{args: []string{"--nope", "."}, err: "unknown flag: --nope"},
+		{args: []string{"-x"}, err: "unknown flag: -x"},
+		{args: []string{"--compact=1"}, err: "--compact does not take a value"},
+		{args: []string{"--arg=x", "y"}, err: "--arg does not take a value"},
+		{args: []string{"--indent"}, err: "--indent needs n"},
+		{args: []string{"--arg", "x"}, err: "--arg needs name and value"},
+		{args: []string{"--indent", "bad", "."}, err: "--indent: not a number"},
+	}
+
+	for _, test := range tests {
+		got := map[string][]string{}
+		rest, err := parseArgs(testFlags(got), test.args)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: expected error %q, got %v", test.args, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+
+		if test.set == nil {
+			test.set = map[string][]string{}
+		}
+		if !reflect.DeepEqual(rest, test.rest) || !reflect.DeepEqual(got, test.set) {
+			t.Errorf("%q: expected %q %q, got %q %q", test.args, test.rest, test.set, rest, got)
+		}
+	}
+}
+
+func TestPrintOptions(t *testing.T) {
+	var buf bytes.Buffer
+	printOptions(&buf, testFlags(nil))
+
+	expected := strings.Join([]string{
+		"  -c, --compact     one line",
+		"  --indent n        indent",
+		"  --arg name value  bind",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
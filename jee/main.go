@@ -1,58 +1,491 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/nytlabs/gojee"
+	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 )
 
-var info = `jee 0.1.1`
+// exit codes
+const (
+	// exitFalse is returned with --exit-status when the final result is not
+	// truthy
+	exitFalse = 1
+	// exitUsage is returned for bad flags or arguments
+	exitUsage = 2
+	// exitCompile is returned when the query cannot be lexed or parsed
+	exitCompile = 3
+	// exitInput is returned when the input is not valid JSON
+	exitInput = 4
+	// exitEval is returned when the query cannot be evaluated or its result
+	// cannot be written
+	exitEval = 5
+)
 
-func main() {
-	var umsg jee.BMsg
+var usage = `jee 0.1.1
+
+usage: jee [flags] query [file...]
+       jee [flags] -f query-file [file...]
+
+jee reads a JSON document from each file in turn, or from stdin if there are
+none, evaluates query against it and writes the result. In a query file, a
+# at the start of a line or after a space, outside of a string, starts a
+comment that runs to the end of the line.
+
+flags:`
+
+var exitHelp = `
+exit status:
+  0  success
+  1  with --exit-status, the final result is not truthy or there is none
+  2  bad flags or arguments
+  3  the query cannot be lexed or parsed
+  4  the input cannot be read or is not valid JSON
+  5  the query cannot be evaluated or its result written`
+
+// printUsage writes the help text to w
+func printUsage(w io.Writer, flags []*option) {
+	fmt.Fprintln(w, usage)
+	printOptions(w, flags)
+	fmt.Fprintln(w, exitHelp)
+}
+
+// fail reports err to stderr and exits with code
+func fail(code int, err error) {
+	fmt.Fprintln(os.Stderr, "jee:", err)
+	os.Exit(code)
+}
 
-	if len(os.Args) != 2 {
-		fmt.Println(info)
-		os.Exit(1)
+// inFile prefixes err with the name of the file it is about, unless the
+// file is stdin
+func inFile(name string, err error) error {
+	if name == "" {
+		return err
 	}
+	return fmt.Errorf("%s: %w", name, err)
+}
 
-	l, err := jee.Lexer(string(os.Args[1]))
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// stripComments blanks out the comments of a query read from a file. A # at
+// the start of a line or after a space, outside of a string, starts a comment
+// that runs to the end of the line. Comments are replaced by spaces, so that
+// errors point at the line and column of the file they are on.
+func stripComments(query string) string {
+	b := []byte(query)
+	var quote byte
+	var escaped, comment bool
+	for i, c := range b {
+		switch {
+		case comment:
+			if c == '\n' {
+				comment = false
+			} else {
+				b[i] = ' '
+			}
+		case quote != 0:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == quote:
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || strings.IndexByte(" \t\r\n", b[i-1]) >= 0):
+			comment = true
+			b[i] = ' '
+		}
 	}
+	return string(b)
+}
 
-	tree, err := jee.Parser(l)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// eachInput calls fn with each of files in turn, or with stdin if there are
+// none. With nullInput, fn is called once with the JSON document null
+// instead. name is empty for stdin and null input.
+func eachInput(files []string, nullInput bool, fn func(name string, r io.Reader)) {
+	switch {
+	case nullInput:
+		fn("", strings.NewReader("null"))
+		return
+	case len(files) == 0:
+		fn("", os.Stdin)
+		return
+	}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			fail(exitInput, err)
+		}
+		fn(name, f)
+		f.Close()
+	}
+}
+
+// outputError is an error formatting or writing a result
+type outputError struct {
+	err error
+}
+
+func (e *outputError) Error() string {
+	return e.err.Error()
+}
+
+func (e *outputError) Unwrap() error {
+	return e.err
+}
+
+// errorCode returns the exit code for an error returned by evaluator.eval or
+// streamer.run. Errors that are not evaluation or output errors come from
+// reading the input.
+func errorCode(err error) int {
+	var evalErr *jee.EvalError
+	var outErr *outputError
+	if errors.As(err, &evalErr) || errors.As(err, &outErr) {
+		return exitEval
+	}
+	return exitInput
+}
+
+// decode unmarshals a JSON document. With useNumber, numbers are decoded as
+// json.Number so that integers too large for a float64 stay exact.
+func decode(data []byte, useNumber bool) (interface{}, error) {
+	var v interface{}
+	if !useNumber {
+		err := json.Unmarshal(data, &v)
+		return v, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid character after top-level value")
+	}
+	return v, nil
+}
+
+// evaluator evaluates the query against JSON documents
+type evaluator struct {
+	e    *jee.Expression
+	vars map[string]interface{}
+}
+
+// eval evaluates the query against data. Only the parts of data the query
+// reads are decoded.
+func (ev *evaluator) eval(data []byte) (interface{}, error) {
+	return ev.e.EvalBytesWithVars(data, ev.vars)
+}
+
+// streamer evaluates the query against each of a stream of JSON values in
+// turn
+type streamer struct {
+	ev  *evaluator
+	out *output
+	// errors are reported to errw and the value is skipped if skipErrors
+	// is set, otherwise an error stops the stream
+	errw       io.Writer
+	skipErrors bool
+	// skipped is the exit status for the values skipped, exitInput if any
+	// was not valid JSON, exitEval if any failed to evaluate, or 0
+	skipped int
+	// filter writes the values the query is truthy for instead of results
+	filter bool
+	// last is the result for the last value evaluated without error, if
+	// hasResult is set
+	last      interface{}
+	hasResult bool
+}
+
+// run reads JSON values from r until it ends. With skipErrors, a value that
+// is not valid JSON is skipped up to the end of the line it starts on and the
+// stream resumes on the next line. name is the name of the file r reads, or
+// empty for stdin.
+func (s *streamer) run(name string, r io.Reader) error {
+	// read holds what dec has read from r since the start of the current
+	// value, so that the stream can resume from there after a bad value.
+	// The decoder reads ahead, and a value cut short can run on over the
+	// lines after it.
+	var read bytes.Buffer
+	dec := json.NewDecoder(io.TeeReader(r, &read))
+	var offset int64
+
+	for n := 1; ; n++ {
+		start := dec.InputOffset()
+		read.Next(int(start - offset))
+		offset = start
+
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			_, syntax := err.(*json.SyntaxError)
+			if !s.skipErrors || !syntax && err != io.ErrUnexpectedEOF {
+				return fmt.Errorf("%s: %w", recordName(name, n), err)
+			}
+			s.skip(name, n, err, exitInput)
+
+			rest, err := skipLine(io.MultiReader(bytes.NewReader(read.Bytes()), r))
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			r = rest
+			read.Reset()
+			dec = json.NewDecoder(io.TeeReader(r, &read))
+			offset = 0
+			continue
+		}
+
+		out, err := s.record(raw)
+		if err != nil {
+			if !s.skipErrors {
+				return fmt.Errorf("%s: %w", recordName(name, n), err)
+			}
+			s.skip(name, n, err, errorCode(err))
+			continue
+		}
+		if out != nil {
+			if _, err := s.out.w.Write(out); err != nil {
+				return &outputError{err}
+			}
+		}
+	}
+}
+
+// skip reports the error err of record n of the file name, which is
+// skipped, and notes the exit status code it calls for
+func (s *streamer) skip(name string, n int, err error, code int) {
+	fmt.Fprintf(s.errw, "%s: %v\n", recordName(name, n), err)
+	if s.skipped != exitInput {
+		s.skipped = code
+	}
+}
+
+// recordName names record n of the file name, which is empty for stdin
+func recordName(name string, n int) string {
+	if name == "" {
+		return fmt.Sprintf("record %d", n)
 	}
+	return fmt.Sprintf("%s: record %d", name, n)
+}
 
-	j, err := ioutil.ReadAll(os.Stdin)
+// record returns the line to write for one value, or nil for none
+func (s *streamer) record(raw json.RawMessage) ([]byte, error) {
+	result, err := s.ev.eval(raw)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
+	s.last, s.hasResult = result, true
 
-	err = json.Unmarshal(j, &umsg)
+	var out []byte
+	switch {
+	case !s.filter:
+		out, err = s.out.format(result)
+	case jee.Truthy(result):
+		out, err = s.out.formatJSON(raw)
+	}
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, &outputError{err}
+	}
+	return out, nil
+}
+
+// skipLine discards r up to the end of the line the next value is on
+func skipLine(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			break
+		}
+	}
+
+	_, err := br.ReadBytes('\n')
+	return br, err
+}
+
+func main() {
+	var useNumber, streaming, filter, skipErrors, exitStatus, nullInput bool
+	var indent *string
+	var queryFile string
+
+	out := &output{
+		w:     os.Stdout,
+		color: isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "",
 	}
 
-	result, err := jee.Eval(tree, umsg)
+	vars := make(map[string]interface{})
+	jsonVars := make(map[string]string)
+
+	flags := []*option{
+		{name: "--from-file", short: "-f", args: []string{"file"}, help: "read the query from file", set: func(vals []string) error {
+			queryFile = vals[0]
+			return nil
+		}},
+		{name: "--null-input", short: "-n", help: "evaluate the query once against null instead of reading input", set: setTrue(&nullInput)},
+		{name: "--stream", help: "evaluate the query against each of a stream of JSON values", set: setTrue(&streaming)},
+		{name: "--filter", help: "write the values the query is truthy for instead of results", set: setTrue(&filter)},
+		{name: "--skip-errors", help: "report records that fail with --stream or --filter and go on", set: setTrue(&skipErrors)},
+		{name: "--use-number", help: "keep integers beyond 2^53 exact instead of rounding them", set: setTrue(&useNumber)},
+		{name: "--exit-status", short: "-e", help: "exit with 1 if the final result is not truthy", set: setTrue(&exitStatus)},
+		{name: "--compact", short: "-c", help: "write each result on one line", set: func([]string) error {
+			indent = new(string)
+			return nil
+		}},
+		{name: "--indent", args: []string{"n"}, help: "indent with n spaces, from 0 to 8", set: func(vals []string) error {
+			n, err := strconv.Atoi(vals[0])
+			if err != nil || n < 0 || n > 8 {
+				return fmt.Errorf("must be a number from 0 to 8: %s", vals[0])
+			}
+			spaces := strings.Repeat(" ", n)
+			indent = &spaces
+			return nil
+		}},
+		{name: "--tab", help: "indent with tabs", set: func([]string) error {
+			tab := "\t"
+			indent = &tab
+			return nil
+		}},
+		{name: "--raw", short: "-r", help: "write string results without quotes", set: setTrue(&out.raw)},
+		{name: "--sort-keys", help: "sort the keys of records written by --filter", set: setTrue(&out.sortKeys)},
+		{name: "--color", help: "color the output", set: func([]string) error {
+			out.color = true
+			return nil
+		}},
+		{name: "--no-color", help: "do not color the output", set: func([]string) error {
+			out.color = false
+			return nil
+		}},
+		{name: "--arg", args: []string{"name", "value"}, help: "bind @name to the string value", set: func(vals []string) error {
+			vars[vals[0]] = vals[1]
+			delete(jsonVars, vals[0])
+			return nil
+		}},
+		{name: "--argjson", args: []string{"name", "json"}, help: "bind @name to the JSON value json", set: func(vals []string) error {
+			jsonVars[vals[0]] = vals[1]
+			return nil
+		}},
+	}
+
+	args, err := parseArgs(flags, os.Args[1:])
+	if err == errHelp {
+		printUsage(os.Stdout, flags)
+		return
+	}
+	var query string
+	switch {
+	case err != nil:
+	case queryFile == "" && len(args) == 0:
+		err = errors.New("no query given")
+	case queryFile == "":
+		query, args = args[0], args[1:]
+	}
+	if err == nil && nullInput && len(args) > 0 {
+		err = fmt.Errorf("no input files are read with --null-input: %s", args[0])
+	}
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fail(exitUsage, fmt.Errorf("%v\nrun jee --help for usage", err))
+	}
+
+	if queryFile != "" {
+		b, err := ioutil.ReadFile(queryFile)
+		if err != nil {
+			fail(exitUsage, err)
+		}
+		query = stripComments(string(b))
+	}
+
+	// --argjson values are decoded once every flag is known
+	for name, value := range jsonVars {
+		v, err := decode([]byte(value), useNumber)
+		if err != nil {
+			fail(exitUsage, fmt.Errorf("--argjson %s: %v", name, err))
+		}
+		vars[name] = v
 	}
 
-	r, err := json.MarshalIndent(result, "", "    ")
+	var opts []jee.Option
+	if useNumber {
+		opts = append(opts, jee.WithUseNumber())
+	}
+	e, err := jee.Compile(query, opts...)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fail(exitCompile, err)
+	}
+
+	ev := &evaluator{e: e, vars: vars}
+
+	switch {
+	case indent != nil:
+		out.indent = *indent
+	case filter:
+		// records are written as they were read
+		out.verbatim = true
+	case !streaming:
+		out.indent = "    "
 	}
 
-	fmt.Println(string(r))
+	var result interface{}
+	if streaming || filter {
+		s := &streamer{
+			ev:         ev,
+			out:        out,
+			errw:       os.Stderr,
+			skipErrors: skipErrors,
+			filter:     filter,
+		}
+		eachInput(args, nullInput, func(name string, r io.Reader) {
+			if err := s.run(name, r); err != nil {
+				fail(errorCode(err), err)
+			}
+		})
+		if s.skipped != 0 {
+			os.Exit(s.skipped)
+		}
+		if exitStatus && !s.hasResult {
+			os.Exit(exitFalse)
+		}
+		result = s.last
+	} else {
+		eachInput(args, nullInput, func(name string, r io.Reader) {
+			j, err := ioutil.ReadAll(r)
+			if err != nil {
+				fail(exitInput, inFile(name, err))
+			}
+
+			result, err = ev.eval(j)
+			if err != nil {
+				fail(errorCode(err), inFile(name, err))
+			}
+
+			if err := out.write(result); err != nil {
+				fail(exitEval, err)
+			}
+		})
+	}
+
+	if exitStatus && !jee.Truthy(result) {
+		os.Exit(exitFalse)
+	}
 }
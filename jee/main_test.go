@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/nytlabs/gojee"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		data      string
+		useNumber bool
+		expected  interface{}
+		ok        bool
+	}{
+		{`{"a": 1}`, false, map[string]interface{}{"a": 1.0}, true},
+		{`{"a": 1}`, true, map[string]interface{}{"a": json.Number("1")}, true},
+		{` 12345678901234567890 `, true, json.Number("12345678901234567890"), true},
+		{`{"a": 1} x`, false, nil, false},
+		{`{"a": 1} x`, true, nil, false},
+		{`{"a": 1} 2`, true, nil, false},
+		{`{"a": 1} {`, true, nil, false},
+		{`{"a": `, true, nil, false},
+		{``, true, nil, false},
+	}
+
+	for _, test := range tests {
+		v, err := decode([]byte(test.data), test.useNumber)
+		if test.ok != (err == nil) {
+			t.Errorf("%q: expected ok %v, got %v", test.data, test.ok, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("%q: expected %#v, got %#v", test.data, test.expected, v)
+		}
+	}
+}
+
+// newStreamer returns a streamer for query that writes compact results to
+// out and reports errors to errw
+func newStreamer(t *testing.T, query string, out, errw *bytes.Buffer) *streamer {
+	e, err := jee.Compile(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &streamer{
+		ev:   &evaluator{e: e},
+		out:  &output{w: out},
+		errw: errw,
+	}
+}
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		query      string
+		input      string
+		skipErrors bool
+		filter     bool
+		out        string
+		errors     string
+		err        string
+		skipped    int
+	}{
+		{
+			input: "{\"a\": 1}\n{\"a\": 2}\n",
+			out:   "1\n2\n",
+		},
+		{
+			input: `{"a": 1} {"a": 2}{}  {"b": 3}`,
+			out:   "1\n2\nnull\nnull\n",
+		},
+		{
+			input: "",
+		},
+		{
+			input: "{\"a\": 1}\n{\"a\": x}\n{\"a\": 3}\n",
+			out:   "1\n",
+			err:   "record 2: invalid character 'x' looking for beginning of value",
+		},
+		{
+			input:      "{\"a\": 1}\n{\"a\": x}\n{\"a\": 3}\n",
+			skipErrors: true,
+			out:        "1\n3\n",
+			errors:     "record 2: invalid character 'x' looking for beginning of value\n",
+			skipped:    exitInput,
+		},
+		{
+			// a value cut short runs on into the next line
+			input:      "{\"a\": 1}\n{\"a\":\n{\"a\": 3}\n{\"a\": 4}\n",
+			skipErrors: true,
+			out:        "1\n3\n4\n",
+			errors:     "record 2: invalid character '{' after object key:value pair\n",
+			skipped:    exitInput,
+		},
+		{
+			input:      "{\"a\": 1}\n{\"a\": [1, 2\n",
+			skipErrors: true,
+			out:        "1\n",
+			errors:     "record 2: unexpected EOF\n",
+			skipped:    exitInput,
+		},
+		{
+			input: "{\"a\": 1}\n{\"a\": [1, 2\n",
+			out:   "1\n",
+			err:   "record 2: unexpected EOF",
+		},
+		{
+			// the rest of a bad line is skipped, even if it is valid
+			input:      "{\"a\": 1}\n  ] {\"a\": 2}\n\n{\"a\": 3}",
+			skipErrors: true,
+			out:        "1\n3\n",
+			errors:     "record 2: invalid character ']' looking for beginning of value\n",
+			skipped:    exitInput,
+		},
+		{
+			input:      "{\"a\": 1}\n}",
+			skipErrors: true,
+			out:        "1\n",
+			errors:     "record 2: invalid character '}' looking for beginning of value\n",
+			skipped:    exitInput,
+		},
+		{
+			query: ".a * 2",
+			input: "{\"a\": 1}\n{\"a\": \"x\"}\n{\"a\": 3}\n",
+			out:   "2\n",
+			err:   "record 2: cannot compare types: string, float64 at line 1, col 4\n    .a * 2\n       ^",
+		},
+		{
+			query:      ".a * 2",
+			input:      "{\"a\": 1}\n{\"a\": \"x\"}\n{\"a\": 3}\n",
+			skipErrors: true,
+			out:        "2\n6\n",
+			errors:     "record 2: cannot compare types: string, float64 at line 1, col 4\n    .a * 2\n       ^\n",
+			skipped:    exitEval,
+		},
+		{
+			query:      ".a * 2",
+			input:      "{\"a\": 1}\n{\"a\": \"x\"}\n{\"a\":  3}\n{\"a\": 0}\n",
+			filter:     true,
+			skipErrors: true,
+			out:        "{\"a\":1}\n{\"a\":3}\n",
+			errors:     "record 2: cannot compare types: string, float64 at line 1, col 4\n    .a * 2\n       ^\n",
+			skipped:    exitEval,
+		},
+		{
+			// a record that is not valid JSON calls for exitInput, even
+			// after one that failed to evaluate
+			query:      ".a * 2",
+			input:      "{\"a\": \"x\"}\nx\n{\"a\": true}\n",
+			skipErrors: true,
+			errors: "record 1: cannot compare types: string, float64 at line 1, col 4\n    .a * 2\n       ^\n" +
+				"record 2: invalid character 'x' looking for beginning of value\n" +
+				"record 3: cannot compare types: bool, float64 at line 1, col 4\n    .a * 2\n       ^\n",
+			skipped: exitInput,
+		},
+	}
+
+	for _, test := range tests {
+		if test.query == "" {
+			test.query = ".a"
+		}
+
+		var out, errw bytes.Buffer
+		s := newStreamer(t, test.query, &out, &errw)
+		s.skipErrors = test.skipErrors
+		s.filter = test.filter
+
+		err := s.run("", strings.NewReader(test.input))
+		if err == nil && test.err != "" || err != nil && err.Error() != test.err {
+			t.Errorf("%q: expected error %q, got %v", test.input, test.err, err)
+		}
+		if out.String() != test.out {
+			t.Errorf("%q: expected output %q, got %q", test.input, test.out, out.String())
+		}
+		if errw.String() != test.errors {
+			t.Errorf("%q: expected errors %q, got %q", test.input, test.errors, errw.String())
+		}
+		if s.skipped != test.skipped {
+			t.Errorf("%q: expected exit status %d for skipped records, got %d", test.input, test.skipped, s.skipped)
+		}
+	}
+}
+
+func TestStreamFileName(t *testing.T) {
+	var out, errw bytes.Buffer
+	s := newStreamer(t, ".a", &out, &errw)
+	s.skipErrors = true
+
+	if err := s.run("in.json", strings.NewReader("{\"a\": 1}\nx\n")); err != nil {
+		t.Fatal(err)
+	}
+	expected := "in.json: record 2: invalid character 'x' looking for beginning of value\n"
+	if errw.String() != expected {
+		t.Errorf("expected %q, got %q", expected, errw.String())
+	}
+	if !s.hasResult || s.last != 1.0 {
+		t.Errorf("expected last result 1, got %v %v", s.hasResult, s.last)
+	}
+}
+
+func TestSkipLine(t *testing.T) {
+	tests := []struct {
+		input string
+		rest  string
+		err   error
+	}{
+		{"x\ny", "y", nil},
+		{"\n\n  x y\n  z\n", "  z\n", nil},
+		{"x", "", io.EOF},
+		{" \n ", "", io.EOF},
+		{"", "", io.EOF},
+	}
+
+	for _, test := range tests {
+		r, err := skipLine(strings.NewReader(test.input))
+		if err != test.err {
+			t.Errorf("%q: expected error %v, got %v", test.input, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != test.rest {
+			t.Errorf("%q: expected %q left, got %q", test.input, test.rest, rest)
+		}
+	}
+}
+
+// failWriter fails every write
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		query  string
+		input  string
+		stream bool
+		w      io.Writer
+		code   int
+	}{
+		{query: ".a * 2", input: `{"a": "x"}`, code: exitEval},
+		{query: "@nope", input: `{}`, code: exitEval},
+		{query: ".a", input: `{"a": `, code: exitInput},
+		{query: ".a", input: `{"a": 1} x`, code: exitInput},
+		{query: ".a * 2", input: `{"a": 1} {"a": "x"}`, stream: true, code: exitEval},
+		{query: ".a", input: `{"a": 1} {"a": x}`, stream: true, code: exitInput},
+		{query: ".a", input: `{"a": 1} {"a": `, stream: true, code: exitInput},
+		{query: ".a", input: `{"a": 1}`, stream: true, w: failWriter{}, code: exitEval},
+		{query: "0 / 0", input: `{}`, stream: true, code: exitEval},
+	}
+
+	for _, test := range tests {
+		var out, errw bytes.Buffer
+		s := newStreamer(t, test.query, &out, &errw)
+		if test.w != nil {
+			s.out.w = test.w
+		}
+
+		var err error
+		if test.stream {
+			err = s.run("in.json", strings.NewReader(test.input))
+		} else {
+			_, err = s.ev.eval([]byte(test.input))
+			err = inFile("in.json", err)
+		}
+		if err == nil {
+			t.Errorf("%s on %s: expected an error", test.query, test.input)
+			continue
+		}
+		if code := errorCode(err); code != test.code {
+			t.Errorf("%s on %s: expected exit code %d, got %d for %v", test.query, test.input, test.code, code, err)
+		}
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{".a + .b", ".a + .b"},
+		{"# all\n.a # the a\n  + .b\t# the b", "     \n.a        \n  + .b\t       "},
+		{"#\n#\n.a", " \n \n.a"},
+		{".a# x", ".a# x"},
+		{".#id # id", ".#id     "},
+		{`"# a" + '# b' # c`, `"# a" + '# b'    `},
+		{`"\"# a" # b`, `"\"# a"    `},
+		{`'\\' # a`, `'\\'    `},
+		{"# é\r\n.a", "     \n.a"},
+	}
+
+	for _, test := range tests {
+		if s := stripComments(test.query); s != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.query, test.expected, s)
+		}
+	}
+}
+
+func TestQueryFileErrors(t *testing.T) {
+	_, err := jee.Compile(stripComments("# a comment\n.a + # another\n  ;"))
+	expected := "unexpected token: ; at line 3, col 3\n      ;\n      ^"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%v", expected, err)
+	}
+
+	// a # right after a key is part of the key
+	if _, err := jee.Compile(stripComments(".a# x")); err == nil {
+		t.Error("expected an error for .a# x")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ANSI colors for each kind of value
+const (
+	colorNull   = "1;30"
+	colorBool   = "0;33"
+	colorNumber = "0;36"
+	colorString = "0;32"
+	colorKey    = "1;34"
+	colorNest   = "1;39"
+)
+
+// output writes results as JSON, one per line
+type output struct {
+	w io.Writer
+	// indent is repeated once per level of nesting. Without it, each value
+	// is written on one line.
+	indent string
+	// raw writes a string result without quotes
+	raw bool
+	// sortKeys writes the keys of JSON documents copied from the input in
+	// sorted order. The keys of results are always sorted.
+	sortKeys bool
+	// color highlights values with ANSI escape codes
+	color bool
+	// verbatim copies JSON documents from the input as they were read
+	verbatim bool
+}
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// write writes a result to o.w
+func (o *output) write(v interface{}) error {
+	b, err := o.format(v)
+	if err != nil {
+		return err
+	}
+	_, err = o.w.Write(b)
+	return err
+}
+
+// format returns the line written for a result
+func (o *output) format(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok && o.raw {
+		return []byte(s + "\n"), nil
+	}
+
+	var buf bytes.Buffer
+	if err := o.encode(&buf, v, 0); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// formatJSON returns the line written for a JSON document from the input.
+// Unless it has to be decoded to be colored or sorted, the order of its keys
+// and the form of its numbers are kept.
+func (o *output) formatJSON(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch {
+	case o.color || o.sortKeys:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		return o.format(v)
+	case o.verbatim:
+		buf.Write(data)
+	case o.indent == "":
+		err = json.Compact(&buf, data)
+	default:
+		err = json.Indent(&buf, data, "", o.indent)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (o *output) encode(buf *bytes.Buffer, v interface{}, depth int) error {
+	switch t := v.(type) {
+	case nil:
+		o.colored(buf, colorNull, "null")
+	case bool:
+		o.colored(buf, colorBool, strconv.FormatBool(t))
+	case json.Number:
+		o.colored(buf, colorNumber, string(t))
+	case int64:
+		o.colored(buf, colorNumber, strconv.FormatInt(t, 10))
+	case *big.Int:
+		o.colored(buf, colorNumber, t.String())
+	case float64:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		o.colored(buf, colorNumber, string(b))
+	case string:
+		b, _ := json.Marshal(t)
+		o.colored(buf, colorString, string(b))
+	case []interface{}:
+		if len(t) == 0 {
+			o.colored(buf, colorNest, "[]")
+			break
+		}
+
+		o.colored(buf, colorNest, "[")
+		for i, e := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			o.newline(buf, depth+1)
+			if err := o.encode(buf, e, depth+1); err != nil {
+				return err
+			}
+		}
+		o.newline(buf, depth)
+		o.colored(buf, colorNest, "]")
+	case map[string]interface{}:
+		if len(t) == 0 {
+			o.colored(buf, colorNest, "{}")
+			break
+		}
+
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		o.colored(buf, colorNest, "{")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			o.newline(buf, depth+1)
+			b, _ := json.Marshal(k)
+			o.colored(buf, colorKey, string(b))
+			buf.WriteByte(':')
+			if o.indent != "" {
+				buf.WriteByte(' ')
+			}
+			if err := o.encode(buf, t[k], depth+1); err != nil {
+				return err
+			}
+		}
+		o.newline(buf, depth)
+		o.colored(buf, colorNest, "}")
+	default:
+		// anything else is written as encoding/json writes it
+		b, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if o.indent == "" {
+			buf.Write(b)
+			break
+		}
+		return json.Indent(buf, b, strings.Repeat(o.indent, depth), o.indent)
+	}
+	return nil
+}
+
+// newline starts a line at depth if values are indented
+func (o *output) newline(buf *bytes.Buffer, depth int) {
+	if o.indent == "" {
+		return
+	}
+	buf.WriteByte('\n')
+	for i := 0; i < depth; i++ {
+		buf.WriteString(o.indent)
+	}
+}
+
+func (o *output) colored(buf *bytes.Buffer, color, s string) {
+	if !o.color {
+		buf.WriteString(s)
+		return
+	}
+	buf.WriteString("\x1b[" + color + "m" + s + "\x1b[0m")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/big"
+	"testing"
+)
+
+// testResult is written by the tests of output.format
+var testResult = map[string]interface{}{
+	"b": []interface{}{1.5, "x", nil},
+	"a": map[string]interface{}{"t": true, "e": []interface{}{}, "o": map[string]interface{}{}},
+}
+
+func TestFormat(t *testing.T) {
+	big1e20, _ := new(big.Int).SetString("100000000000000000000", 10)
+
+	tests := []struct {
+		out      output
+		v        interface{}
+		expected string
+	}{
+		{output{}, testResult, `{"a":{"e":[],"o":{},"t":true},"b":[1.5,"x",null]}`},
+		{output{indent: "  "}, testResult, `{
+  "a": {
+    "e": [],
+    "o": {},
+    "t": true
+  },
+  "b": [
+    1.5,
+    "x",
+    null
+  ]
+}`},
+		{output{indent: "\t"}, []interface{}{[]interface{}{1.0}}, "[\n\t[\n\t\t1\n\t]\n]"},
+		{output{color: true}, map[string]interface{}{"k": []interface{}{"s", 1.0, false, nil}},
+			"\x1b[1;39m{\x1b[0m\x1b[1;34m\"k\"\x1b[0m:\x1b[1;39m[\x1b[0m" +
+				"\x1b[0;32m\"s\"\x1b[0m,\x1b[0;36m1\x1b[0m,\x1b[0;33mfalse\x1b[0m,\x1b[1;30mnull\x1b[0m" +
+				"\x1b[1;39m]\x1b[0m\x1b[1;39m}\x1b[0m"},
+		{output{color: true}, []interface{}{}, "\x1b[1;39m[]\x1b[0m"},
+		{output{raw: true}, "a \"b\"\n", "a \"b\"\n"},
+		{output{raw: true}, []interface{}{"a"}, `["a"]`},
+		{output{}, "a \"b\"", `"a \"b\""`},
+		{output{}, json.Number("12345678901234567890"), `12345678901234567890`},
+		{output{}, int64(math.MaxInt64), `9223372036854775807`},
+		{output{}, big1e20, `100000000000000000000`},
+		{output{}, 1e21, `1e+21`},
+		{output{indent: "  "}, []interface{}{map[string]int{"n": 1}}, "[\n  {\n    \"n\": 1\n  }\n]"},
+	}
+
+	for _, test := range tests {
+		b, err := test.out.format(test.v)
+		if err != nil {
+			t.Errorf("%v: %v", test.v, err)
+			continue
+		}
+		if string(b) != test.expected+"\n" {
+			t.Errorf("%v: expected\n%s\ngot\n%s", test.v, test.expected, b)
+		}
+	}
+
+	if _, err := (&output{}).format(math.NaN()); err == nil {
+		t.Error("expected an error for NaN")
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	const doc = `{"b": 1, "a": [1.50, {}]}`
+
+	tests := []struct {
+		out      output
+		expected string
+	}{
+		{output{verbatim: true}, doc},
+		{output{}, `{"b":1,"a":[1.50,{}]}`},
+		{output{indent: "  "}, "{\n  \"b\": 1,\n  \"a\": [\n    1.50,\n    {}\n  ]\n}"},
+		{output{verbatim: true, sortKeys: true}, `{"a":[1.50,{}],"b":1}`},
+		{output{sortKeys: true, indent: "\t"}, "{\n\t\"a\": [\n\t\t1.50,\n\t\t{}\n\t],\n\t\"b\": 1\n}"},
+		{output{verbatim: true, color: true}, "\x1b[1;39m{\x1b[0m" +
+			"\x1b[1;34m\"a\"\x1b[0m:\x1b[1;39m[\x1b[0m\x1b[0;36m1.50\x1b[0m,\x1b[1;39m{}\x1b[0m\x1b[1;39m]\x1b[0m," +
+			"\x1b[1;34m\"b\"\x1b[0m:\x1b[0;36m1\x1b[0m" +
+			"\x1b[1;39m}\x1b[0m"},
+	}
+
+	for _, test := range tests {
+		b, err := test.out.formatJSON([]byte(doc))
+		if err != nil {
+			t.Errorf("%+v: %v", test.out, err)
+			continue
+		}
+		if string(b) != test.expected+"\n" {
+			t.Errorf("%+v: expected\n%s\ngot\n%s", test.out, test.expected, b)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	o := &output{w: &buf, raw: true}
+	for _, v := range []interface{}{"a", 1.0, "b"} {
+		if err := o.write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.String() != "a\n1\nb\n" {
+		t.Errorf("expected %q, got %q", "a\n1\nb\n", buf.String())
+	}
+}
@@ -136,6 +136,10 @@ var Tests = []Test{
 	},
 	Test{
 		exp:    `(true && false) && true == false`,
+		result: `false`,
+	},
+	Test{
+		exp:    `((true && false) && true) == false`,
 		result: `true`,
 	},
 	Test{
@@ -186,6 +190,32 @@ var Tests = []Test{
 		exp:    `(true || false) && true && true`,
 		result: `true`,
 	},
+	// the right side of && and || is not evaluated when the left side
+	// decides the result, so it cannot cause an error
+	Test{
+		exp:    `$exists(., "nope") && .nope.b > 3`,
+		result: `false`,
+	},
+	Test{
+		exp:    `!$exists(., "nope") || .nope.b > 3`,
+		result: `true`,
+	},
+	Test{
+		exp:    `true || .string > 1`,
+		result: `true`,
+	},
+	Test{
+		exp:    `false && $sum(.arrayString) > 1`,
+		result: `false`,
+	},
+	Test{
+		exp:    `.int < 0 && .string - 1 || .int > 0`,
+		result: `true`,
+	},
+	Test{
+		exp:    `.arrayObj[? $exists(., "hasKey") && .hasKey].name`,
+		result: `["foo"]`,
+	},
 	Test{
 		exp:    `false`,
 		result: `false`,
@@ -378,6 +408,14 @@ var Tests = []Test{
 		exp:    `$min(.arrayObj[].array[])`,
 		result: `1`,
 	},
+	Test{
+		exp:    `$min(.empty)`,
+		result: `null`,
+	},
+	Test{
+		exp:    `$max(.empty)`,
+		result: `null`,
+	},
 	Test{
 		exp:    `$floor(.arrayFloat[0])`,
 		result: `1`,
@@ -419,6 +457,26 @@ var Tests = []Test{
 		exp:    `$has(.arrayFloat, 1.1)`,
 		result: `true`,
 	},
+	Test{
+		exp:    `$has(.arrayString, 1)`,
+		result: `false`,
+	},
+	Test{
+		exp:    `$has(.arrayObj[].nil, null)`,
+		result: `true`,
+	},
+	Test{
+		exp:    `.arrayInt != .arrayInt`,
+		result: `false`,
+	},
+	Test{
+		exp:    `.arrayInt != .arrayFloat`,
+		result: `true`,
+	},
+	Test{
+		exp:    `$num(true) + 1`,
+		result: `2`,
+	},
 	Test{
 		exp:    `$has($keys(.), "arrayString") || $has($keys(.), "nope") `,
 		result: `true`,
@@ -511,6 +569,279 @@ var Tests = []Test{
 		exp:	`$~bool(1)`,
 		result: `true`,
 	},
+	Test{
+		exp:    `if .int == 5 then "five" else "other" end`,
+		result: `"five"`,
+	},
+	Test{
+		exp:    `if .int > 5 then "big" elif .int == 5 then "five" else "small" end`,
+		result: `"five"`,
+	},
+	Test{
+		exp:    `if .bool then .arrayInt[0] else .arrayInt[1] end`,
+		result: `2`,
+	},
+	Test{
+		exp:    `.int > 3 ? "big" : "small"`,
+		result: `"big"`,
+	},
+	Test{
+		exp:    `.int > 10 ? "big" : .int > 3 ? "medium" : "small"`,
+		result: `"medium"`,
+	},
+	Test{
+		exp:    `(.bool ? 1 : 2) * 10`,
+		result: `20`,
+	},
+	Test{
+		exp:    `$sum(.arrayInt) > 50 ? $max(.arrayInt) : $min(.arrayInt)`,
+		result: `10`,
+	},
+	// the branch that is not selected is never evaluated
+	Test{
+		exp:    `if true then 1 else "a" - 1 end`,
+		result: `1`,
+	},
+	Test{
+		exp:    `false ? $sum(.string[]) : .int`,
+		result: `5`,
+	},
+	Test{
+		exp:    `let $total = $sum(.arrayInt) in $total / $len(.arrayInt) > 5 && $total < 1000`,
+		result: `true`,
+	},
+	Test{
+		exp:    `let $a = .int, $b = $a * 2 in $a + $b`,
+		result: `15`,
+	},
+	Test{
+		exp:    `let $x = 1 in let $x = $x + 1 in $x`,
+		result: `2`,
+	},
+	Test{
+		exp:    `(let $x = 1 in $x) + (let $x = 2 in $x)`,
+		result: `3`,
+	},
+	Test{
+		exp:    `let $o = .arrayObj in $o[1].name`,
+		result: `"bar"`,
+	},
+	Test{
+		exp:    `let $o = .arrayObj in $o[].nested[].id`,
+		result: `["foo","zof","zif"]`,
+	},
+	Test{
+		exp:    `let $k = "int" in .[$k]`,
+		result: `5`,
+	},
+	Test{
+		exp:    `let $now = 5 in $now + $now() * 0`,
+		result: `5`,
+	},
+	Test{
+		exp:    `let $now = 5 in $now * 2`,
+		result: `10`,
+	},
+	Test{
+		exp:    `.int==-5 || .int>-1`,
+		result: `true`,
+	},
+	Test{
+		exp:    `{"id": .arrayObj[0].nested[0].id, "tags": [.int, .float]}`,
+		result: `{"id":"foo","tags":[5,5.5]}`,
+	},
+	Test{
+		exp:    `{id: .int, 'str': .string, if: true}`,
+		result: `{"id":5,"str":"hello world","if":true}`,
+	},
+	Test{
+		exp:    `{(.arrayObj[1].name): .int, ("k" + $str(.int)): null}`,
+		result: `{"bar":5,"k5":null}`,
+	},
+	Test{
+		exp:    `{"size": .int > 3 ? "big" : "small", "n": -1}`,
+		result: `{"size":"big","n":-1}`,
+	},
+	Test{
+		exp:    `{}`,
+		result: `{}`,
+	},
+	Test{
+		exp:    `[]`,
+		result: `[]`,
+	},
+	Test{
+		exp:    `[[1, 2], {"a": [true, null]}, "s"]`,
+		result: `[[1,2],{"a":[true,null]},"s"]`,
+	},
+	Test{
+		exp:    `[.arrayObj[].name]`,
+		result: `[["foo","bar","baz"]]`,
+	},
+	Test{
+		exp:    `$sum([.int, .float]) + $len([1, 2, 3])`,
+		result: `13.5`,
+	},
+	Test{
+		exp:    `let $p = {"x": .int, "y": [.two]} in $p.x + $p.y[0]`,
+		result: `7`,
+	},
+	Test{
+		exp:    `{"nested": {"keys": $len($keys({a: 1, b: 2}))}}`,
+		result: `{"nested":{"keys":2}}`,
+	},
+	Test{
+		exp:    `.arrayObj | $len(.)`,
+		result: `3`,
+	},
+	Test{
+		exp:    `.arrayObj[0] | .name + "!"`,
+		result: `"foo!"`,
+	},
+	Test{
+		exp:    `.nested | .foo.zip`,
+		result: `"zap"`,
+	},
+	Test{
+		exp:    `.arrayInt | $sum(.) / $len(.)`,
+		result: `5.5`,
+	},
+	Test{
+		exp:    `.arrayObj[].array[] | $max(.)`,
+		result: `9`,
+	},
+	Test{
+		exp:    `.int | . * 2 | . + 1`,
+		result: `11`,
+	},
+	Test{
+		exp:    `{a: .int, b: [.two]} | .a + .b[0]`,
+		result: `7`,
+	},
+	Test{
+		exp:    `.a | .b | .c[1] | .d["e"]`,
+		result: `1`,
+	},
+	Test{
+		exp:    `let $i = .two in .arrayObj | .[$i].name`,
+		result: `"baz"`,
+	},
+	Test{
+		exp:    `true || false | . == true`,
+		result: `true`,
+	},
+	Test{
+		exp:    `.arrayObj[? .val > 2].name`,
+		result: `["bar","baz"]`,
+	},
+	Test{
+		exp:    `.arrayObj[? .bool]['name']`,
+		result: `["bar"]`,
+	},
+	Test{
+		exp:    `.arrayInt[? . > 8]`,
+		result: `[9,10]`,
+	},
+	Test{
+		exp:    `.arrayObj[? .name == "nope"]`,
+		result: `[]`,
+	},
+	Test{
+		exp:    `$len(.arrayObj[? .val > 2])`,
+		result: `2`,
+	},
+	Test{
+		exp:    `.arrayObj[].nested[? .id != "foo"].id`,
+		result: `["zof","zif"]`,
+	},
+	Test{
+		exp:    `.arrayObj[? $has(.array, 2)].val`,
+		result: `[2,2.5]`,
+	},
+	Test{
+		exp:    `let $min = 2 in .arrayObj[? .val > $min && !.bool].name`,
+		result: `["baz"]`,
+	},
+	Test{
+		exp:    `.arrayObj[? $len(.array[? . > 5]) > 0].name`,
+		result: `["baz"]`,
+	},
+	Test{
+		exp:    `$sum(.arrayObj[? .val < 5].array[])`,
+		result: `12`,
+	},
+	Test{
+		exp:    `$map(.arrayInt, . * 2)`,
+		result: `[2,4,6,8,10,12,14,16,18,20]`,
+	},
+	Test{
+		exp:    `$map(.arrayObj, {"n": .name, "v": .val})`,
+		result: `[{"n":"foo","v":2},{"n":"bar","v":2.5},{"n":"baz","v":10}]`,
+	},
+	Test{
+		exp:    `$map([1, 2, 3], $x -> $x * $x)`,
+		result: `[1,4,9]`,
+	},
+	Test{
+		exp:    `$map(.arrayObj, $o -> $count(.array, . > $o.val))`,
+		result: `[1,1,0]`,
+	},
+	Test{
+		exp:    `let $k = 2 in $map(.arrayInt[? . <= 3], . * $k)`,
+		result: `[2,4,6]`,
+	},
+	Test{
+		exp:    `$filter(.arrayInt, . > 8)`,
+		result: `[9,10]`,
+	},
+	Test{
+		exp:    `$reduce(.arrayInt, 0, $acc + .)`,
+		result: `55`,
+	},
+	Test{
+		exp:    `$reduce(.arrayObj, "", $acc + .name)`,
+		result: `"foobarbaz"`,
+	},
+	Test{
+		exp:    `$reduce([1, 2, 3], 1, $x -> $acc * $x)`,
+		result: `6`,
+	},
+	Test{
+		exp:    `$reduce(.empty, "none", $acc + .)`,
+		result: `"none"`,
+	},
+	Test{
+		exp:    `$any(.arrayInt, . > 9)`,
+		result: `true`,
+	},
+	Test{
+		exp:    `$any(.empty, true)`,
+		result: `false`,
+	},
+	Test{
+		exp:    `$all(.arrayInt, . > 0)`,
+		result: `true`,
+	},
+	Test{
+		exp:    `$all(.arrayObj, .bool)`,
+		result: `false`,
+	},
+	Test{
+		exp:    `$all(.empty, false)`,
+		result: `true`,
+	},
+	Test{
+		exp:    `$count(.arrayObj, .val > 2)`,
+		result: `2`,
+	},
+	Test{
+		exp:    `$count(.arrayObj, $any(.nested, .id == "zof"))`,
+		result: `1`,
+	},
+	Test{
+		exp:    `$map(.string, . * 2)`,
+		result: `null`,
+	},
 }
 
 func TestAll(t *testing.T) {
@@ -554,6 +885,254 @@ func TestAll(t *testing.T) {
 	}
 }
 
+type PrecedenceTest struct {
+	exp    string
+	tree   string
+	result string
+}
+
+// each level is pinned against its neighbours in both orders, and every
+// binary level is checked for left associativity
+var PrecedenceTests = []PrecedenceTest{
+	// unary
+	PrecedenceTest{`-.int * 2`, `(* (- int) 2)`, `-10`},
+	PrecedenceTest{`!true == false`, `(== (! true) false)`, `true`},
+	PrecedenceTest{`!(.int == 5)`, `(! (== int 5))`, `false`},
+	PrecedenceTest{`- -.int`, `(- (- int))`, `5`},
+	PrecedenceTest{`-$abs(-3)`, `(- ($abs (- 3)))`, `-3`},
+	// multiplicative
+	PrecedenceTest{`2 * 3 + 4`, `(+ (* 2 3) 4)`, `10`},
+	PrecedenceTest{`4 + 2 * 3`, `(+ 4 (* 2 3))`, `10`},
+	PrecedenceTest{`8 / 4 / 2`, `(/ (/ 8 4) 2)`, `1`},
+	PrecedenceTest{`8 / 4 * 2`, `(* (/ 8 4) 2)`, `4`},
+	// additive
+	PrecedenceTest{`1 - 2 - 3`, `(- (- 1 2) 3)`, `-4`},
+	PrecedenceTest{`1 - 2 + 3`, `(+ (- 1 2) 3)`, `2`},
+	PrecedenceTest{`.int + 1 == 6`, `(== (+ int 1) 6)`, `true`},
+	PrecedenceTest{`6 == .int + 1`, `(== 6 (+ int 1))`, `true`},
+	// comparison
+	PrecedenceTest{`.int == 5 && .float == 5.5`, `(&& (== int 5) (== float 5.5))`, `true`},
+	PrecedenceTest{`.int > 4 || .int < 4`, `(|| (> int 4) (< int 4))`, `true`},
+	PrecedenceTest{`1 < 2 == true`, `(== (< 1 2) true)`, `true`},
+	// &&
+	PrecedenceTest{`true || false && false`, `(|| true (&& false false))`, `true`},
+	PrecedenceTest{`false && false || true`, `(|| (&& false false) true)`, `true`},
+	PrecedenceTest{`true && false && true`, `(&& (&& true false) true)`, `false`},
+	// ||
+	PrecedenceTest{`false || false || true`, `(|| (|| false false) true)`, `true`},
+	// ternary
+	PrecedenceTest{`true ? 1 : 2 + 3`, `(? true 1 (+ 2 3))`, `1`},
+	PrecedenceTest{`false || true ? 1 : 2`, `(? (|| false true) 1 2)`, `1`},
+	PrecedenceTest{`false ? 1 : true ? 2 : 3`, `(? false 1 (? true 2 3))`, `2`},
+	PrecedenceTest{`true ? false ? 1 : 2 : 3`, `(? true (? false 1 2) 3)`, `2`},
+	PrecedenceTest{`if true then 1 else 2 end + 1`, `(+ (? true 1 2) 1)`, `2`},
+	// let
+	PrecedenceTest{`let $x = 1 in $x + 1 == 2`, `(let $x 1 (== (+ $x 1) 2))`, `true`},
+	PrecedenceTest{`1 + let $x = 2 in $x * 3`, `(+ 1 (let $x 2 (* $x 3)))`, `7`},
+	// pipe
+	PrecedenceTest{`1 + 1 | . * 2`, `(| (+ 1 1) (* . 2))`, `4`},
+	PrecedenceTest{`1 | . + 1 | . * 3`, `(| (| 1 (+ . 1)) (* . 3))`, `6`},
+	PrecedenceTest{`true ? 1 : 2 | . + 1`, `(| (? true 1 2) (+ . 1))`, `2`},
+	PrecedenceTest{`false || true | !.`, `(| (|| false true) (! .))`, `false`},
+	PrecedenceTest{`let $x = 2 in $x | . * $x`, `(let $x 2 (| $x (* . $x)))`, `4`},
+	PrecedenceTest{`(1 | . + 1) * 2`, `(* (| 1 (+ . 1)) 2)`, `4`},
+	// filter predicates are full expressions
+	PrecedenceTest{`.arrayInt[? . > 2 && . < 5]`, `(arrayInt [? (&& (> . 2) (< . 5))])`, `[3,4]`},
+	// lambda bodies extend to the end of the argument
+	PrecedenceTest{`$map([1], $x -> $x + 1 == 2)`, `($map ([] 1) (-> $x (== (+ $x 1) 2)))`, `[true]`},
+	// parentheses override everything
+	PrecedenceTest{`(1 + 2) * 3`, `(* (+ 1 2) 3)`, `9`},
+	PrecedenceTest{`1 - (2 - 3)`, `(- 1 (- 2 3))`, `2`},
+	PrecedenceTest{`(true || false) && false`, `(&& (|| true false) false)`, `false`},
+	// keys and function arguments
+	PrecedenceTest{`.arrayInt[1 + 1] * 2`, `(* (arrayInt [(+ 1 1)]) 2)`, `6`},
+	PrecedenceTest{`$pow(1 + 1, 2 * 2) - 1`, `(- ($pow (+ 1 1) (* 2 2)) 1)`, `15`},
+}
+
+// sexpr renders a tree with every operation parenthesized
+func sexpr(t *TokenTree) string {
+	switch t.Type {
+	case ZERO:
+		return sexpr(t.Tokens[0])
+	case ARRAY:
+		s := "([]"
+		for _, sub := range t.Tokens {
+			s += " " + sexpr(sub)
+		}
+		return s + ")"
+	case OP, FUNC:
+		s := "(" + t.Value.(string)
+		for _, sub := range t.Tokens {
+			s += " " + sexpr(sub)
+		}
+		return s + ")"
+	case LAMBDA:
+		return "(-> " + t.Value.(string) + " " + sexpr(t.Tokens[0]) + ")"
+	case LET:
+		return "(let " + t.Value.(string) + " " + sexpr(t.Tokens[0]) + " " + sexpr(t.Tokens[1]) + ")"
+	case COND:
+		return "(? " + sexpr(t.Tokens[0]) + " " + sexpr(t.Tokens[1]) + " " + sexpr(t.Tokens[2]) + ")"
+	case KEY, VAR:
+		name := t.Value.(string)
+		if name == "" {
+			name = "."
+		}
+		if len(t.Tokens) == 0 {
+			return name
+		}
+		s := "(" + name
+		for _, sub := range t.Tokens {
+			if sub.Type == KEY {
+				s += " ." + sub.Value.(string)
+			} else if sub.Type == FILTER {
+				s += " [? " + sexpr(sub.Tokens[0]) + "]"
+			} else if len(sub.Tokens) == 0 {
+				s += " []"
+			} else {
+				s += " [" + sexpr(sub.Tokens[0]) + "]"
+			}
+		}
+		return s + ")"
+	}
+	return fmt.Sprint(t.Value)
+}
+
+func TestPrecedence(t *testing.T) {
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+
+	json.Unmarshal(testFile, &umsg)
+
+	for _, test := range PrecedenceTests {
+		tokenized, err := Lexer(test.exp)
+		if err != nil {
+			t.Error("failed lex", test.exp)
+			continue
+		}
+
+		tree, err := Parser(tokenized)
+		if err != nil {
+			t.Error("failed parse", test.exp, err)
+			continue
+		}
+
+		if s := sexpr(tree); s != test.tree {
+			t.Error(test.exp, "parsed as", s, "expected", test.tree)
+		}
+
+		result, err := Eval(tree, umsg)
+		if err != nil {
+			t.Error("failed eval", test.exp, err)
+			continue
+		}
+
+		var rmsg BMsg
+		json.Unmarshal([]byte(test.result), &rmsg)
+		if !reflect.DeepEqual(rmsg, result) {
+			t.Error(test.exp, "expected", rmsg, "got", result)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, exp := range []string{`(1 + 2`, `1 + 2)`, `.a[0`, `1 +`, `$pow(1, 2`, `(1)(2)`, `foo`, `1 2`,
+		`{1: 2}`, `{"a" 1}`, `{"a": 1`, `{"a": 1,}`, `[1, 2`, `[1 2]`, `{.a: 1}`, `{"a": 1]`, `.a[?]`, `.a[? .b`, `$map(.a, $x ->)`,
+		`true ? 1`, `true ? 1 :`, `if true then 1 end`, `if true 1 else 2 end`, `if true then 1 else 2`, `then`, `"abc`,
+		`let x = 1 in x`, `let $x 1 in $x`, `let $x = 1 $x`, `let $x = 1 in`, `let $x = 1, in $x`, `.a = 1`} {
+		tokenized, err := Lexer(exp)
+		if err != nil {
+			continue
+		}
+		if _, err := Parser(tokenized); err == nil {
+			t.Error("expected parse error for", exp)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for _, exp := range []string{
+		`if 1 then 2 else 3 end`, `null ? 1 : 2`, `"true" ? 1 : 2`,
+		`$undefined + 1`, `(let $x = 1 in $x) + $x`,
+		`{(1): 2}`, `{(null): 2}`, `[1, "a" - 1]`,
+		`.arrayInt[? .]`, `.int[? true]`, `.arrayInt[? . > "a"]`,
+		`$any(.arrayInt, .)`, `$map(.arrayInt)`, `$sum($x -> $x)`, `$reduce(.arrayInt, $acc, .)`,
+		`$map(.arrayInt, . - "a")`,
+		`true && .string > 1`, `false || .string - 1`, `.int && true`, `.nil || true`, `true && .int`,
+	} {
+		tokenized, _ := Lexer(exp)
+		tree, err := Parser(tokenized)
+		if err != nil {
+			t.Error("failed parse", exp, err)
+			continue
+		}
+		if _, err := Eval(tree, nil); err == nil {
+			t.Error("expected eval error:", exp)
+		}
+	}
+}
+
+func TestEvalWithVars(t *testing.T) {
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+
+	json.Unmarshal(testFile, &umsg)
+
+	vars := map[string]interface{}{
+		"threshold": 3,
+		"name":      "bar",
+		"user":      map[string]interface{}{"id": "zof", "ids": []interface{}{"foo", "zif"}},
+		"quote":     `" || true || "`,
+	}
+
+	tests := []Test{
+		Test{exp: `.int > @threshold`, result: `true`},
+		Test{exp: `@threshold * 2`, result: `6`},
+		Test{exp: `.arrayObj[1].name == @name`, result: `true`},
+		Test{exp: `@user.id`, result: `"zof"`},
+		Test{exp: `@user["ids"][1]`, result: `"zif"`},
+		Test{exp: `.arrayObj[1].nested[0].id == @user.id`, result: `true`},
+		Test{exp: `let $t = @threshold + 1 in $t`, result: `4`},
+		Test{exp: `.string == @quote`, result: `false`},
+		Test{exp: `@quote`, result: `"\" || true || \""`},
+	}
+
+	for _, test := range tests {
+		tokenized, err := Lexer(test.exp)
+		if err != nil {
+			t.Error("failed lex", test.exp)
+			continue
+		}
+
+		tree, err := Parser(tokenized)
+		if err != nil {
+			t.Error("failed parse", test.exp, err)
+			continue
+		}
+
+		result, err := EvalWithVars(tree, umsg, vars)
+		if err != nil {
+			t.Error("failed eval", test.exp, err)
+			continue
+		}
+
+		var rmsg BMsg
+		json.Unmarshal([]byte(test.result), &rmsg)
+		if !reflect.DeepEqual(rmsg, result) {
+			t.Error(test.exp, "expected", rmsg, "got", result)
+		}
+	}
+
+	e := MustCompile(`@missing`)
+	if _, err := e.EvalWithVars(umsg, vars); err == nil {
+		t.Error("expected undefined variable error")
+	}
+	if _, err := e.Eval(umsg); err == nil {
+		t.Error("expected undefined variable error")
+	}
+}
+
 func BenchmarkJSON(b *testing.B) {
 	var umsg BMsg
 	testFile, _ := ioutil.ReadFile("test.json")
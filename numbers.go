@@ -0,0 +1,271 @@
+package jee
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// Numbers are float64, like json.Unmarshal gives them, except integers too
+// large for a float64 to hold exactly. Those stay exact: an int64 if they
+// fit in one, otherwise a *big.Int. int64 and json.Number values in messages
+// and integer literals in queries get the same treatment, so a 64-bit id
+// compares and prints exactly.
+//
+// Arithmetic on two integers is exact, whether they are exact values or
+// float64s with no fractional part, and so is division that leaves no
+// remainder. Everything else is done in float64.
+
+// maxExact is the largest integer below which every integer is a float64
+const maxExact = 1 << 53
+
+// number returns v as a number in the form above, and whether it is one
+func number(v interface{}) (interface{}, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		if n >= -maxExact && n <= maxExact {
+			return float64(n), true
+		}
+		return n, true
+	case *big.Int:
+		return normalizeInt(n), true
+	case json.Number:
+		r, err := parseNumber(string(n))
+		if err != nil {
+			return nil, false
+		}
+		return r, true
+	}
+	return nil, false
+}
+
+// parseNumber parses a number literal, keeping integers exact
+func parseNumber(lit string) (interface{}, error) {
+	if isIntLiteral(lit) && len(lit) > 15 {
+		if i, ok := new(big.Int).SetString(lit, 10); ok {
+			return normalizeInt(i), nil
+		}
+	}
+	return strconv.ParseFloat(lit, 64)
+}
+
+func isIntLiteral(lit string) bool {
+	if len(lit) > 0 && lit[0] == '-' {
+		lit = lit[1:]
+	}
+	for i := 0; i < len(lit); i++ {
+		if !isDigit(lit[i]) {
+			return false
+		}
+	}
+	return len(lit) > 0
+}
+
+// normalizeInt returns i as a number in the form above. i is not copied and
+// must not be modified afterwards.
+func normalizeInt(i *big.Int) interface{} {
+	if !i.IsInt64() {
+		return i
+	}
+	n := i.Int64()
+	if n >= -maxExact && n <= maxExact {
+		return float64(n)
+	}
+	return n
+}
+
+// isExactFloat reports whether f is an integer that float64 arithmetic may
+// not keep exact
+func isExactFloat(f float64) bool {
+	return f == math.Trunc(f) && f >= -maxExact && f <= maxExact
+}
+
+// toInt returns a number as a *big.Int if it is an integer. The result must
+// not be modified.
+func toInt(n interface{}) (*big.Int, bool) {
+	switch c := n.(type) {
+	case float64:
+		if c != math.Trunc(c) || math.IsInf(c, 0) {
+			return nil, false
+		}
+		if c >= -maxExact && c <= maxExact {
+			return big.NewInt(int64(c)), true
+		}
+		i, _ := big.NewFloat(c).Int(nil)
+		return i, true
+	case int64:
+		return big.NewInt(c), true
+	case *big.Int:
+		return c, true
+	}
+	return nil, false
+}
+
+// toFloat returns a number as the nearest float64
+func toFloat(n interface{}) float64 {
+	switch c := n.(type) {
+	case float64:
+		return c
+	case int64:
+		return float64(c)
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(c).Float64()
+		return f
+	}
+	return math.NaN()
+}
+
+var opFuncsInt = map[string]func(*big.Int, *big.Int) interface{}{
+	"+": func(a, b *big.Int) interface{} {
+		return normalizeInt(new(big.Int).Add(a, b))
+	},
+	"-": func(a, b *big.Int) interface{} {
+		return normalizeInt(new(big.Int).Sub(a, b))
+	},
+	"*": func(a, b *big.Int) interface{} {
+		return normalizeInt(new(big.Int).Mul(a, b))
+	},
+	"/": func(a, b *big.Int) interface{} {
+		if b.Sign() == 0 {
+			return nil
+		}
+		q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+		if r.Sign() != 0 {
+			return nil
+		}
+		return normalizeInt(q)
+	},
+	"==": func(a, b *big.Int) interface{} {
+		return a.Cmp(b) == 0
+	},
+	">=": func(a, b *big.Int) interface{} {
+		return a.Cmp(b) >= 0
+	},
+	">": func(a, b *big.Int) interface{} {
+		return a.Cmp(b) > 0
+	},
+	"<": func(a, b *big.Int) interface{} {
+		return a.Cmp(b) < 0
+	},
+	"<=": func(a, b *big.Int) interface{} {
+		return a.Cmp(b) <= 0
+	},
+	"!=": func(a, b *big.Int) interface{} {
+		return a.Cmp(b) != 0
+	},
+}
+
+// numberOperator applies op to two numbers, exactly if they are both
+// integers. It returns nil if op has no implementation for numbers.
+func numberOperator(op *operator, a, b interface{}) interface{} {
+	fa, ok := a.(float64)
+	fb, ok2 := b.(float64)
+	if ok && ok2 && op.float != nil {
+		r := op.float(fa, fb)
+		// only a float64 result this large may have lost integer
+		// precision
+		f, ok := r.(float64)
+		if !ok || op.integer == nil || f > -maxExact && f < maxExact || !isExactFloat(fa) || !isExactFloat(fb) {
+			return r
+		}
+	}
+
+	if op.integer != nil {
+		if ia, ok := toInt(a); ok {
+			if ib, ok := toInt(b); ok {
+				if r := op.integer(ia, ib); r != nil {
+					return r
+				}
+			}
+		}
+	}
+
+	if op.float == nil {
+		return nil
+	}
+	return op.float(toFloat(a), toFloat(b))
+}
+
+// compareNumbers compares two numbers. It returns false if either is NaN.
+func compareNumbers(a, b interface{}) (int, bool) {
+	if ia, ok := toInt(a); ok {
+		if ib, ok := toInt(b); ok {
+			return ia.Cmp(ib), true
+		}
+	}
+
+	fa, fb := toFloat(a), toFloat(b)
+	switch {
+	case fa < fb:
+		return -1, true
+	case fa > fb:
+		return 1, true
+	case fa == fb:
+		return 0, true
+	}
+	return 0, false
+}
+
+// equalValues reports whether two values are equal, comparing numbers by
+// value whatever their type
+func equalValues(a, b interface{}) bool {
+	switch ta := a.(type) {
+	case []interface{}:
+		tb, ok := b.([]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !equalValues(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		tb, ok := b.(map[string]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for k, v := range ta {
+			w, ok := tb[k]
+			if !ok || !equalValues(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if na, ok := number(a); ok {
+		nb, ok := number(b)
+		if !ok {
+			return false
+		}
+		c, ok := compareNumbers(na, nb)
+		return ok && c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// extremeNumber returns the lesser of two numbers if sign is -1, or the greater
+// if it is 1. Two float64s are compared with f, so that NaN is returned if
+// either is NaN.
+func extremeNumber(a, b interface{}, f func(float64, float64) float64, sign int) interface{} {
+	fa, ok := a.(float64)
+	fb, ok2 := b.(float64)
+	if ok && ok2 {
+		return f(fa, fb)
+	}
+
+	c, ok := compareNumbers(a, b)
+	switch {
+	case !ok:
+		return math.NaN()
+	case c == sign || c == 0:
+		return a
+	}
+	return b
+}
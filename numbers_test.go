@@ -0,0 +1,128 @@
+package jee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+var NumberTests = []Test{
+	Test{exp: `.id`, result: `1234567890123456789`},
+	Test{exp: `.id + 1`, result: `1234567890123456790`},
+	Test{exp: `.id - .id`, result: `0`},
+	Test{exp: `.id * 10`, result: `12345678901234567890`},
+	Test{exp: `.id * 10 / 10`, result: `1234567890123456789`},
+	Test{exp: `.id / 2`, result: `617283945061728400`},
+	Test{exp: `.id == 1234567890123456789`, result: `true`},
+	Test{exp: `.id == 1234567890123456788`, result: `false`},
+	Test{exp: `.id > 1234567890123456788`, result: `true`},
+	Test{exp: `.id < 1.5`, result: `false`},
+	Test{exp: `.id != "x"`, result: `true`},
+	Test{exp: `-.id`, result: `-1234567890123456789`},
+	Test{exp: `.small + 1`, result: `4`},
+	Test{exp: `.small / 2`, result: `1.5`},
+	Test{exp: `.half * 2`, result: `3`},
+	Test{exp: `.ids[1]`, result: `1234567890123456789`},
+	Test{exp: `.ids[.small - 3]`, result: `1`},
+	Test{exp: `.ids[9223372036854775807]`, result: `null`},
+	Test{exp: `.ids == [1, 1234567890123456789]`, result: `true`},
+	Test{exp: `{"a": .id} == {"a": 1234567890123456789}`, result: `true`},
+	Test{exp: `$str(.id)`, result: `"1234567890123456789"`},
+	Test{exp: `$str(.ids)`, result: `"[1,1234567890123456789]"`},
+	Test{exp: `$num("1234567890123456789") == .id`, result: `true`},
+	Test{exp: `$sum(.ids)`, result: `1234567890123456790`},
+	Test{exp: `$max(.ids)`, result: `1234567890123456789`},
+	Test{exp: `$min(.ids)`, result: `1`},
+	Test{exp: `$has(.ids, 1234567890123456789)`, result: `true`},
+	Test{exp: `$has(.ids, 1234567890123456788)`, result: `false`},
+	Test{exp: `$abs(-.id)`, result: `1234567890123456789`},
+	Test{exp: `$floor(.id)`, result: `1234567890123456789`},
+	Test{exp: `$~bool(.id)`, result: `true`},
+	Test{exp: `$sqrt(.small * .small)`, result: `3`},
+	Test{exp: `9007199254740992 + 1`, result: `9007199254740993`},
+	Test{exp: `9007199254740993 - 9007199254740992`, result: `1`},
+	Test{exp: `9223372036854775807 + 1`, result: `9223372036854775808`},
+	Test{exp: `@i64 + 1`, result: `9223372036854775807`},
+	Test{exp: `@big - 1`, result: `99999999999999999999`},
+	Test{exp: `@num == .id`, result: `true`},
+	Test{exp: `@i64 == 9223372036854775806`, result: `true`},
+	Test{exp: `@small + 1`, result: `3`},
+}
+
+func TestNumbers(t *testing.T) {
+	doc := []byte(`{"id": 1234567890123456789, "small": 3, "half": 1.5, "ids": [1, 1234567890123456789]}`)
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var msg interface{}
+	if err := dec.Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	big1e20, _ := new(big.Int).SetString("100000000000000000000", 10)
+	vars := map[string]interface{}{
+		"i64":   int64(math.MaxInt64 - 1),
+		"big":   big1e20,
+		"num":   json.Number("1234567890123456789"),
+		"small": int64(2),
+	}
+
+	for _, test := range NumberTests {
+		e := MustCompile(test.exp)
+		checkSameEval(t, e, msg, vars)
+
+		result, err := e.EvalWithVars(msg, vars)
+		if err != nil {
+			t.Error(test.exp, err)
+			continue
+		}
+
+		// EvalBytes decodes the document the same way with WithUseNumber
+		b := MustCompile(test.exp, WithUseNumber())
+		fromBytes, err := b.EvalBytesWithVars(doc, vars)
+		if err != nil || fmt.Sprintf("%#v", fromBytes) != fmt.Sprintf("%#v", result) {
+			t.Errorf("%s: expected %#v from EvalBytes, got %#v %v", test.exp, result, fromBytes, err)
+		}
+
+		// compare as JSON, which does not tell exact numbers apart
+		r, _ := json.Marshal(result)
+		if string(r) != test.result {
+			t.Errorf("%s: expected %s, got %s", test.exp, test.result, r)
+		}
+	}
+}
+
+func TestNumberForms(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		expected interface{}
+	}{
+		{int64(3), 3.0},
+		{int64(-maxExact), float64(-maxExact)},
+		{int64(maxExact + 1), int64(maxExact + 1)},
+		{uint64(math.MaxUint64), new(big.Int).SetUint64(math.MaxUint64)},
+		{json.Number("12"), 12.0},
+		{json.Number("1.5e3"), 1500.0},
+		{json.Number("9007199254740993"), int64(9007199254740993)},
+		{big.NewInt(5), 5.0},
+		{struct{ N int64 }{math.MaxInt64}, map[string]interface{}{"N": int64(math.MaxInt64)}},
+	}
+
+	for _, test := range tests {
+		v, err := toValue(test.v)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("%v: expected %#v, got %#v", test.v, test.expected, v)
+		}
+	}
+
+	if _, err := toValue(json.Number("x")); err == nil {
+		t.Error("expected an error for an invalid json.Number")
+	}
+}
@@ -0,0 +1,158 @@
+package jee
+
+import (
+	"math"
+	"math/big"
+)
+
+// Optimize returns a copy of a tree from Parser that evaluates to the same
+// results with less work:
+//
+//   - subtrees made only of constants, operators and calls to pure functions
+//     are evaluated once, e.g. 60 * 60 * 1000 becomes 3600000
+//   - conditionals with a constant condition are replaced by their branch
+//   - true || x and false && x become true and false, x is never evaluated
+//   - !!x becomes x when x is always a bool
+//
+// Subtrees that fail to evaluate are left alone so that they fail when, and
+// only if, they are evaluated. t is not modified.
+func Optimize(t *TokenTree) *TokenTree {
+	return optimize(t, nil)
+}
+
+// optimize optimizes t, calling the functions in funcs. If funcs is nil,
+// functions are looked up in the global registry.
+func optimize(t *TokenTree, funcs map[string]*Func) *TokenTree {
+	o := &optimizer{sc: &scope{g: &globals{funcs: funcs}}}
+	n := o.node(t)
+	n.Parent = nil
+	n.query = t.query
+	return n
+}
+
+type optimizer struct {
+	// the scope constant subtrees are evaluated in. It binds no variables.
+	sc *scope
+}
+
+func (o *optimizer) node(t *TokenTree) *TokenTree {
+	n := &TokenTree{
+		Type:  t.Type,
+		Value: t.Value,
+		Pos:   t.Pos,
+	}
+	for _, sub := range t.Tokens {
+		appendTree(n, o.node(sub))
+	}
+
+	switch n.Type {
+	case OP:
+		return o.op(n)
+	case COND:
+		if c, ok := n.Tokens[0].Value.(bool); ok && isConstant(n.Tokens[0]) {
+			if c {
+				return n.Tokens[1]
+			}
+			return n.Tokens[2]
+		}
+	case FUNC:
+		name, _ := n.Value.(string)
+		f := o.sc.lookupFunc(name)
+		if f != nil && f.Pure && f.acceptsArgs(len(n.Tokens)) && allConstant(n.Tokens) {
+			return o.fold(n)
+		}
+	}
+
+	return n
+}
+
+func (o *optimizer) op(n *TokenTree) *TokenTree {
+	if len(n.Tokens) == 1 {
+		// !!x is x if x is a bool, otherwise it is an error
+		if sub := n.Tokens[0]; n.Value == "!" && sub.Type == OP && sub.Value == "!" && len(sub.Tokens) == 1 &&
+			staticType(sub.Tokens[0]) == TypeBool {
+			return sub.Tokens[0]
+		}
+	}
+
+	if len(n.Tokens) == 2 {
+		a, b := n.Tokens[0], n.Tokens[1]
+		if c, ok := a.Value.(bool); ok && isConstant(a) {
+			switch {
+			case n.Value == "||" && c, n.Value == "&&" && !c:
+				return a
+			case (n.Value == "||" || n.Value == "&&") && staticType(b) == TypeBool:
+				// false || x and true && x are x
+				return b
+			}
+		}
+	}
+
+	// the right side of a pipe is evaluated against the left side, so it
+	// can only be folded if both sides are constant too
+	if allConstant(n.Tokens) {
+		return o.fold(n)
+	}
+	return n
+}
+
+// fold evaluates a constant subtree. It is left alone if it fails to
+// evaluate or evaluates to something that is not a number, string, bool or
+// null.
+func (o *optimizer) fold(n *TokenTree) *TokenTree {
+	v, err := eval(n, nil, o.sc)
+	if err != nil {
+		return n
+	}
+
+	switch c := v.(type) {
+	case float64:
+		if math.IsNaN(c) || math.IsInf(c, 0) {
+			return n
+		}
+		return numberTree(n.Pos, c, math.Signbit(c))
+	case int64:
+		return numberTree(n.Pos, c, c < 0)
+	case *big.Int:
+		return numberTree(n.Pos, c, c.Sign() < 0)
+	case string:
+		return newTree(n.Pos, D_STR, c)
+	case bool, nil:
+		return newTree(n.Pos, RESERVED, c)
+	}
+	return n
+}
+
+// numberTree returns the tree Parser builds for the number c: a CONST, or the
+// unary - of a CONST if c is negative, as Parser has no negative literals.
+func numberTree(pos Position, c interface{}, negative bool) *TokenTree {
+	if !negative {
+		return newTree(pos, CONST, c)
+	}
+	abs, _ := unaryOperator(nil, "-", c)
+	return newTree(pos, OP, "-", newTree(pos, CONST, abs))
+}
+
+// isNegative reports whether t is the unary - of a CONST, like -5
+func isNegative(t *TokenTree) bool {
+	return t.Type == OP && t.Value == "-" && len(t.Tokens) == 1 && t.Tokens[0].Type == CONST
+}
+
+func isConstant(t *TokenTree) bool {
+	switch t.Type {
+	case CONST, D_STR, S_STR, RESERVED:
+		return true
+	}
+	return false
+}
+
+// allConstant reports whether every tree in tokens is a constant or a
+// negative number, so that a node of them can be folded.
+func allConstant(tokens []*TokenTree) bool {
+	for _, t := range tokens {
+		if !isConstant(t) && !isNegative(t) {
+			return false
+		}
+	}
+	return true
+}
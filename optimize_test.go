@@ -0,0 +1,197 @@
+package jee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+var OptimizeTests = []FormatTest{
+	FormatTest{exp: `60 * 60 * 1000`, formatted: `3600000`},
+	FormatTest{exp: `.int > 60 * 60`, formatted: `.int > 3600`},
+	FormatTest{exp: `.int * 60 * 60`, formatted: `.int * 60 * 60`},
+	FormatTest{exp: `$pow(2, 10) * .int`, formatted: `1024 * .int`},
+	FormatTest{exp: `-(1 + 2)`, formatted: `-3`},
+	FormatTest{exp: `"a" + "b" + .string`, formatted: `"ab" + .string`},
+	FormatTest{exp: `$contains("hello", "ell") && .int > 1`, formatted: `.int > 1`},
+	FormatTest{exp: `!!(.int > 1)`, formatted: `.int > 1`},
+	FormatTest{exp: `!!.bool`, formatted: `!!.bool`},
+	FormatTest{exp: `true || .int`, formatted: `true`},
+	FormatTest{exp: `false && .int`, formatted: `false`},
+	FormatTest{exp: `false || .int > 1`, formatted: `.int > 1`},
+	FormatTest{exp: `true && .int`, formatted: `true && .int`},
+	FormatTest{exp: `.int || true`, formatted: `.int || true`},
+	FormatTest{exp: `1 > 2 ? .a : .b`, formatted: `.b`},
+	FormatTest{exp: `if 2 > 1 then .a elif .b then 1 else 2 end`, formatted: `.a`},
+	FormatTest{exp: `"yes" ? .a : .b`, formatted: `"yes" ? .a : .b`},
+	FormatTest{exp: `.a["b"][1 + 1]`, formatted: `.a["b"][2]`},
+	FormatTest{exp: `.["escape.key"]["nested"]`, formatted: `.["escape.key"]["nested"]`},
+	FormatTest{exp: `let $x = 2 * 3 in $x[$x - 1]`, formatted: `let $x = 6 in $x[$x - 1]`},
+	FormatTest{exp: `$map([1 + 1], . * 2)`, formatted: `$map([2], . * 2)`},
+	FormatTest{exp: `$now() > 0`, formatted: `$now() > 0`},
+	FormatTest{exp: `$regex("a", "(")`, formatted: `$regex("a", "(")`},
+	FormatTest{exp: `$keys({a: 1})`, formatted: `$keys({"a": 1})`},
+	FormatTest{exp: `1 / 0`, formatted: `1 / 0`},
+	FormatTest{exp: `1 | 2`, formatted: `2`},
+	FormatTest{exp: `9007199254740992 + 1`, formatted: `9007199254740993`},
+	FormatTest{exp: `9223372036854775807 + 1`, formatted: `9223372036854775808`},
+	FormatTest{exp: `.int > 0 - 5`, formatted: `.int > -5`},
+	FormatTest{exp: `.int * (0 - 2)`, formatted: `.int * -2`},
+	FormatTest{exp: `.a[0 - 1]`, formatted: `.a[-1]`},
+	FormatTest{exp: `0 * -1`, formatted: `-0`},
+	FormatTest{exp: `0 - 9223372036854775807 - 1`, formatted: `-9223372036854775808`},
+	FormatTest{exp: `1.5 * 10000000000000000000000`, formatted: `15000000000000000000000.0`},
+}
+
+func TestOptimize(t *testing.T) {
+	for _, test := range OptimizeTests {
+		tree := parseString(t, test.exp)
+		before := copyTree(tree)
+
+		optimized := Optimize(tree)
+		if s := optimized.String(); s != test.formatted {
+			t.Errorf("%s: expected %s, got %s", test.exp, test.formatted, s)
+		}
+
+		if !treesEqual(tree, before) {
+			t.Error(test.exp, "was modified by Optimize")
+		}
+	}
+}
+
+// TestOptimizeSameResults checks that every query evaluates to the same
+// result with and without the optimizer. The queries of Tests and
+// OptimizeTests must compile, the fuzz queries and error tests need not.
+func TestOptimizeSameResults(t *testing.T) {
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+
+	vars := map[string]interface{}{"a": []interface{}{1.0, "x", nil}, "b": 1.0}
+
+	compiles := make(map[string]bool)
+	for _, test := range Tests {
+		compiles[test.exp] = true
+	}
+	for _, test := range OptimizeTests {
+		compiles[test.exp] = true
+	}
+
+	for _, exp := range allQueries() {
+		e, err := Compile(exp)
+		if err != nil {
+			if compiles[exp] {
+				t.Error("failed compile", exp, err)
+			}
+			continue
+		}
+		o, err := Compile(exp, WithOptimizer())
+		if err != nil {
+			t.Error("failed optimized compile", exp, err)
+			continue
+		}
+
+		expected, expectedErr := e.EvalWithVars(umsg, vars)
+		result, err := o.EvalWithVars(umsg, vars)
+
+		if (expectedErr == nil) != (err == nil) {
+			t.Errorf("%s: expected error %v, got %v", exp, expectedErr, err)
+			continue
+		}
+
+		// compare as Go syntax so that NaN equals NaN
+		if fmt.Sprintf("%#v", expected) != fmt.Sprintf("%#v", result) {
+			t.Errorf("%s: expected %#v, got %#v", exp, expected, result)
+		}
+	}
+}
+
+func TestOptimizePureFunc(t *testing.T) {
+	var calls int
+	slow := &Func{
+		Params: []Type{TypeNumber},
+		Pure:   true,
+		Fn: func(args []interface{}) (interface{}, error) {
+			calls++
+			return args[0].(float64) + 1, nil
+		},
+	}
+
+	e, err := Compile(`.int > $slow(41)`, WithFunc("slow", slow), WithOptimizer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if r, _ := e.Eval(map[string]interface{}{"int": 50.0}); r != true {
+			t.Error("expected true, got", r)
+		}
+	}
+	if calls != 1 {
+		t.Error("expected $slow to be called once, when compiling, got", calls)
+	}
+
+	calls = 0
+	slow.Pure = false
+	e, _ = Compile(`.int > $slow(41)`, WithFunc("slow", slow), WithOptimizer())
+	e.Eval(map[string]interface{}{"int": 50.0})
+	e.Eval(map[string]interface{}{"int": 50.0})
+	if calls != 2 {
+		t.Error("expected an impure $slow to be called on every Eval, got", calls)
+	}
+}
+
+const foldQuery = `.int > 60 * 60 * 1000 - $pow(2, 10) && .string == "hello" + " " + "world"`
+
+func BenchmarkMathOptimized(b *testing.B) {
+	var umsg BMsg
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+	tokenized, _ := Lexer(`100 * -($sum(.arrayInt) + 5)`)
+	tree, _ := Parser(tokenized)
+	tree = Optimize(tree)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Eval(tree, umsg)
+	}
+}
+
+func BenchmarkFold(b *testing.B) {
+	var umsg BMsg
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+	tokenized, _ := Lexer(foldQuery)
+	tree, _ := Parser(tokenized)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Eval(tree, umsg)
+	}
+}
+
+func BenchmarkFoldOptimized(b *testing.B) {
+	var umsg BMsg
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+	tokenized, _ := Lexer(foldQuery)
+	tree, _ := Parser(tokenized)
+	tree = Optimize(tree)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Eval(tree, umsg)
+	}
+}
+
+func BenchmarkJSONOptimized(b *testing.B) {
+	var umsg BMsg
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+	tokenized, _ := Lexer(`.['arrayObj'][2]['nested'][]['id']`)
+	tree, _ := Parser(tokenized)
+	tree = Optimize(tree)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Eval(tree, umsg)
+	}
+}
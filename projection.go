@@ -0,0 +1,234 @@
+package jee
+
+import (
+	"math/big"
+	"sort"
+)
+
+// Path is a key path into the messages an expression reads. Each key is the
+// name of a member of an object, or "*" for the elements of an array,
+// whatever their index. The value at the end of a path may be read whole.
+type Path struct {
+	Keys []string
+	// Dynamic is set if the path ends where a key is computed from the
+	// message, like .a[.k], so that any member or element may be read.
+	Dynamic bool
+}
+
+// Paths returns the paths of the messages the tree reads, in order. A path
+// with no keys is the whole message. Calls to functions that are not
+// registered are assumed to evaluate every argument against the message.
+func (t *TokenTree) Paths() []Path {
+	return project(t, nil).paths()
+}
+
+// Paths returns the paths of the messages the expression reads. See
+// (*TokenTree).Paths.
+func (e *Expression) Paths() []Path {
+	return e.proj.paths()
+}
+
+// projection is the part of a message an expression can read. Members and
+// elements outside of it never affect the result, so EvalBytes does not
+// decode them.
+type projection struct {
+	// the whole value is read
+	all bool
+	// all is set because a key is computed from the message
+	dynamic bool
+	// the members read of an object
+	fields map[string]*projection
+	// what is read of every element of an array
+	elems *projection
+}
+
+func (p *projection) field(name string) *projection {
+	if p.fields == nil {
+		p.fields = map[string]*projection{}
+	}
+	f, ok := p.fields[name]
+	if !ok {
+		f = &projection{}
+		p.fields[name] = f
+	}
+	return f
+}
+
+func (p *projection) elem() *projection {
+	if p.elems == nil {
+		p.elems = &projection{}
+	}
+	return p.elems
+}
+
+func (p *projection) paths() []Path {
+	var paths []Path
+	if p.all || p.fields != nil || p.elems != nil {
+		p.collect(nil, &paths)
+	}
+	return paths
+}
+
+// collect appends the paths that end at or below p to paths, with members in
+// order and elements last
+func (p *projection) collect(keys []string, paths *[]Path) {
+	if p.all || p.fields == nil && p.elems == nil {
+		*paths = append(*paths, Path{Keys: append([]string{}, keys...), Dynamic: p.dynamic})
+		return
+	}
+
+	var names []string
+	for name := range p.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p.fields[name].collect(append(keys, name), paths)
+	}
+	if p.elems != nil {
+		p.elems.collect(append(keys, "*"), paths)
+	}
+}
+
+// project returns the projection of the messages t is evaluated against,
+// looking up the parameters of functions in funcs. If funcs is nil,
+// functions are looked up in the global registry.
+func project(t *TokenTree, funcs map[string]*Func) *projection {
+	pr := &projector{sc: &scope{g: &globals{funcs: funcs}}}
+	root := &projection{}
+	pr.use(t, root)
+	return root
+}
+
+type projector struct {
+	// the scope functions are looked up in
+	sc *scope
+}
+
+// use records that the value of t, evaluated with dot as ., is read whole.
+// dot is nil where . is not a part of the message, like inside a lambda.
+func (pr *projector) use(t *TokenTree, dot *projection) {
+	if p := pr.value(t, dot); p != nil {
+		p.all = true
+	}
+}
+
+// value records what t reads when it is evaluated with dot as . and returns
+// the part of the message t evaluates to, or nil if t computes a new value.
+// It is up to the caller to record how the returned part is read.
+func (pr *projector) value(t *TokenTree, dot *projection) *projection {
+	if dot == nil {
+		return nil
+	}
+
+	switch t.Type {
+	case KEY:
+		return pr.path(t, dot)
+	case VAR, EXT:
+		// the value is not part of the message, but bracket keys are
+		// evaluated against .
+		for _, sub := range t.Tokens {
+			if sub.Type == K_START && len(sub.Tokens) > 0 {
+				pr.use(sub.Tokens[0], dot)
+			}
+		}
+		return nil
+	case OP:
+		if t.Value == "|" && len(t.Tokens) == 2 {
+			// the right side reads the value of the left side
+			return pr.value(t.Tokens[1], pr.value(t.Tokens[0], dot))
+		}
+	case LET:
+		if len(t.Tokens) == 2 {
+			pr.use(t.Tokens[0], dot)
+			return pr.value(t.Tokens[1], dot)
+		}
+	case FUNC:
+		name, _ := t.Value.(string)
+		f := pr.sc.lookupFunc(name)
+		for i, arg := range t.Tokens {
+			// an expression argument is evaluated against values the
+			// function is given, which are read whole
+			if arg.Type == LAMBDA || f != nil && f.param(i) == TypeExpr {
+				continue
+			}
+			pr.use(arg, dot)
+		}
+		return nil
+	case LAMBDA:
+		return nil
+	case ZERO:
+		if len(t.Tokens) > 0 {
+			return pr.value(t.Tokens[0], dot)
+		}
+		return nil
+	}
+
+	for _, sub := range t.Tokens {
+		pr.use(sub, dot)
+	}
+	return nil
+}
+
+// path records the keys of a KEY node. Accessors after a [] or filter apply
+// to every element of the array, and the result is a new array.
+func (pr *projector) path(t *TokenTree, dot *projection) *projection {
+	name, ok := t.Value.(string)
+	if !ok {
+		return nil
+	}
+
+	// every bracket key is evaluated against . before any is applied
+	for _, sub := range t.Tokens {
+		if sub.Type == K_START && len(sub.Tokens) > 0 {
+			pr.use(sub.Tokens[0], dot)
+		}
+	}
+
+	p := dot
+	if name != "" {
+		p = p.field(name)
+	}
+
+	var fanned bool
+	for _, sub := range t.Tokens {
+		key := sub
+		switch {
+		case sub.Type == K_START && len(sub.Tokens) == 0:
+			p = p.elem()
+			fanned = true
+			continue
+		case sub.Type == FILTER:
+			p = p.elem()
+			if len(sub.Tokens) > 0 {
+				pr.use(sub.Tokens[0], p)
+			}
+			fanned = true
+			continue
+		case sub.Type == K_START && isConstant(sub.Tokens[0]):
+			key = sub.Tokens[0]
+		case sub.Type == K_START:
+			// a computed key, which may be any member or element
+			p.all = true
+			p.dynamic = true
+			return nil
+		}
+
+		switch k := key.Value.(type) {
+		case string:
+			p = p.field(k)
+		case float64, int64, *big.Int:
+			p = p.elem()
+		default:
+			// an invalid key, which fails whatever it is applied to
+			return nil
+		}
+	}
+
+	if fanned {
+		p.all = true
+		return nil
+	}
+	return p
+}
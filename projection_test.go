@@ -0,0 +1,126 @@
+package jee
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// projString writes a projection as {a: *, b: [{c: *}]}, where * is a value
+// read whole
+func projString(p *projection) string {
+	if p.all {
+		return "*"
+	}
+
+	var parts []string
+	if p.fields != nil {
+		var names []string
+		for name := range p.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var fields []string
+		for _, name := range names {
+			fields = append(fields, name+": "+projString(p.fields[name]))
+		}
+		parts = append(parts, "{"+strings.Join(fields, ", ")+"}")
+	}
+	if p.elems != nil {
+		parts = append(parts, "["+projString(p.elems)+"]")
+	}
+	return strings.Join(parts, " ")
+}
+
+type ProjectionTest struct {
+	exp  string
+	proj string
+}
+
+var ProjectionTests = []ProjectionTest{
+	ProjectionTest{`1 + 2`, ``},
+	ProjectionTest{`.`, `*`},
+	ProjectionTest{`.meta.id`, `{meta: {id: *}}`},
+	ProjectionTest{`.a.b == .a.c`, `{a: {b: *, c: *}}`},
+	ProjectionTest{`.a[0].b`, `{a: [{b: *}]}`},
+	ProjectionTest{`.a["b"]`, `{a: {b: *}}`},
+	ProjectionTest{`.a[].b`, `{a: [{b: *}]}`},
+	ProjectionTest{`.a[? .b > 1].c`, `{a: [{b: *, c: *}]}`},
+	ProjectionTest{`.a[.k].c`, `{a: *, k: *}`},
+	ProjectionTest{`.a[.k][.j]`, `{a: *, j: *, k: *}`},
+	ProjectionTest{`.a | .b`, `{a: {b: *}}`},
+	ProjectionTest{`.a[] | .[0]`, `{a: [*]}`},
+	ProjectionTest{`let $x = .a in $x.b + .c`, `{a: *, c: *}`},
+	ProjectionTest{`$map(.a, .b)`, `{a: *}`},
+	ProjectionTest{`$map(.a, $x -> $x.b)`, `{a: *}`},
+	ProjectionTest{`$exists(., "a")`, `*`},
+	ProjectionTest{`.a ? .b : .c`, `{a: *, b: *, c: *}`},
+	ProjectionTest{`@x[.k]`, `{k: *}`},
+	ProjectionTest{`{a: .b}`, `{b: *}`},
+}
+
+func TestProjection(t *testing.T) {
+	for _, test := range ProjectionTests {
+		tree := parseString(t, test.exp)
+		if s := projString(project(tree, nil)); s != test.proj {
+			t.Errorf("%s: expected %s, got %s", test.exp, test.proj, s)
+		}
+	}
+}
+
+type PathTest struct {
+	exp   string
+	paths []Path
+}
+
+var PathTests = []PathTest{
+	PathTest{`1 + 2`, nil},
+	PathTest{`.`, []Path{{Keys: []string{}}}},
+	PathTest{`.meta.id == @id`, []Path{{Keys: []string{"meta", "id"}}}},
+	PathTest{`.arrayObj[2]["nested"][].id`, []Path{{Keys: []string{"arrayObj", "*", "nested", "*", "id"}}}},
+	PathTest{`.b[? .x > 1].y + .a`, []Path{
+		{Keys: []string{"a"}},
+		{Keys: []string{"b", "*", "x"}},
+		{Keys: []string{"b", "*", "y"}},
+	}},
+	PathTest{`.a.b[.k]`, []Path{
+		{Keys: []string{"a", "b"}, Dynamic: true},
+		{Keys: []string{"k"}},
+	}},
+	PathTest{`.a | .b.c`, []Path{{Keys: []string{"a", "b", "c"}}}},
+	PathTest{`.a.b.c == .a`, []Path{{Keys: []string{"a"}}}},
+	PathTest{`.a[true]`, []Path{{Keys: []string{"a"}}}},
+}
+
+func TestPaths(t *testing.T) {
+	for _, test := range PathTests {
+		tree := parseString(t, test.exp)
+		if paths := tree.Paths(); !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: expected %v, got %v", test.exp, test.paths, paths)
+		}
+	}
+}
+
+func TestExpressionPaths(t *testing.T) {
+	apply := &Func{
+		Params: []Type{TypeAny, TypeExpr},
+		Fn: func(args []interface{}) (interface{}, error) {
+			return args[1].(*Lambda).Call(args[0])
+		},
+	}
+
+	// .b is evaluated against the value of .a, not the message
+	e := MustCompile(`$apply(.a, .b)`, WithFunc("apply", apply))
+	expected := []Path{{Keys: []string{"a"}}}
+	if paths := e.Paths(); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	// without the declaration of $apply, .b may read the message
+	expected = []Path{{Keys: []string{"a"}}, {Keys: []string{"b"}}}
+	if paths := parseString(t, `$apply(.a, .b)`).Paths(); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+}
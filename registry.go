@@ -0,0 +1,407 @@
+package jee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Type is the type of a value in a jee expression. Types are used to declare
+// the parameters of a Func.
+type Type int
+
+const (
+	// TypeAny accepts a value of any type, including null.
+	TypeAny Type = iota
+	// TypeNumber accepts any number. Fn is passed it as a float64, unless
+	// the Func declares ExactNumbers.
+	TypeNumber
+	TypeString
+	TypeBool
+	TypeArray
+	TypeObject
+	TypeNull
+	// TypeExpr passes the argument unevaluated, as a *Lambda.
+	TypeExpr
+)
+
+var typeNames = map[Type]string{
+	TypeAny:    "any",
+	TypeNumber: "number",
+	TypeString: "string",
+	TypeBool:   "bool",
+	TypeArray:  "array",
+	TypeObject: "object",
+	TypeNull:   "null",
+	TypeExpr:   "expression",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+// typeOf returns the Type of a value given by json.Unmarshal, or of an
+// exact number
+func typeOf(v interface{}) Type {
+	switch v.(type) {
+	case float64, int64, *big.Int, json.Number:
+		return TypeNumber
+	case string:
+		return TypeString
+	case bool:
+		return TypeBool
+	case []interface{}:
+		return TypeArray
+	case map[string]interface{}:
+		return TypeObject
+	case nil:
+		return TypeNull
+	}
+	return TypeAny
+}
+
+// Func is a function that can be called from a jee expression.
+type Func struct {
+	// Params declares the type of each argument. Arguments are checked
+	// against it when an expression is compiled, as far as their types are
+	// known, and again before Fn is called.
+	Params []Type
+	// Variadic allows the last parameter to be repeated any number of
+	// times, including zero.
+	Variadic bool
+	// Vars are variables bound inside every TypeExpr argument. Their values
+	// are passed to (*Lambda).Call.
+	Vars []string
+	// Pure declares that Fn always returns the same result for the same
+	// arguments and has no side effects. When an expression is optimized,
+	// calls to a pure function with constant arguments are made once, when
+	// the expression is compiled.
+	Pure bool
+	// ExactNumbers passes TypeNumber arguments as a float64, or as an int64
+	// or *big.Int for an integer too large for a float64 to hold exactly.
+	// Without it they are converted to the nearest float64.
+	ExactNumbers bool
+	// Fn is called with one value per argument. TypeExpr arguments are
+	// passed as a *Lambda.
+	Fn func(args []interface{}) (interface{}, error)
+}
+
+func (f *Func) acceptsArgs(n int) bool {
+	if f.Variadic {
+		return n >= len(f.Params)-1
+	}
+	return n == len(f.Params)
+}
+
+// numberArgs converts the TypeNumber arguments in args to the form Fn
+// expects, see ExactNumbers.
+func (f *Func) numberArgs(args []interface{}) {
+	for i, v := range args {
+		if f.param(i) != TypeNumber {
+			continue
+		}
+		n, ok := number(v)
+		if !ok {
+			continue
+		}
+		if !f.ExactNumbers {
+			n = toFloat(n)
+		}
+		args[i] = n
+	}
+}
+
+// param returns the declared type of argument i
+func (f *Func) param(i int) Type {
+	if len(f.Params) == 0 {
+		return TypeAny
+	}
+	if i >= len(f.Params) {
+		return f.Params[len(f.Params)-1]
+	}
+	return f.Params[i]
+}
+
+// Env is a set of functions that expressions can call. Every Env inherits
+// the functions of its parent, and functions registered on an Env shadow
+// those of its parents.
+type Env struct {
+	parent *Env
+	mu     sync.RWMutex
+	funcs  map[string]*Func
+}
+
+// builtinEnv holds the functions that ship with jee. It is filled in by
+// init because the higher-order functions refer back to eval.
+var builtinEnv = &Env{}
+
+// globalEnv holds the functions registered with RegisterFunc. It is used by
+// Parser, Eval and Compile.
+var globalEnv = &Env{parent: builtinEnv, funcs: map[string]*Func{}}
+
+func init() {
+	funcs := exprFuncs()
+
+	for name, fn := range nullaryFuncs {
+		fn := fn
+		funcs[name] = &Func{
+			Fn: func(args []interface{}) (interface{}, error) {
+				return fn()
+			},
+		}
+	}
+
+	for name, fn := range unaryFuncs {
+		fn := fn
+		funcs[name] = &Func{
+			Params: []Type{TypeAny},
+			Pure:   true,
+			Fn: func(args []interface{}) (interface{}, error) {
+				return fn(args[0])
+			},
+		}
+	}
+
+	for name, fn := range binaryFuncs {
+		fn := fn
+		funcs[name] = &Func{
+			Params: []Type{TypeAny, TypeAny},
+			Pure:   true,
+			Fn: func(args []interface{}) (interface{}, error) {
+				return fn(args[0], args[1])
+			},
+		}
+	}
+
+	builtinEnv.funcs = funcs
+}
+
+// NewEnv returns an Env that inherits the built-in functions and every
+// function registered with RegisterFunc.
+func NewEnv() *Env {
+	return &Env{
+		parent: globalEnv,
+		funcs:  map[string]*Func{},
+	}
+}
+
+// RegisterFunc makes fn callable as $name from every expression compiled
+// after it is registered.
+func RegisterFunc(name string, fn *Func) error {
+	return globalEnv.RegisterFunc(name, fn)
+}
+
+// RegisterFunc makes fn callable as $name from expressions compiled with e.
+// The leading $ of name is optional.
+func (e *Env) RegisterFunc(name string, fn *Func) error {
+	name, err := funcName(name)
+	if err != nil {
+		return err
+	}
+
+	if fn == nil || fn.Fn == nil {
+		return errors.New(fmt.Sprintf("func has no implementation: %s", name))
+	}
+
+	if fn.Variadic && len(fn.Params) == 0 {
+		return errors.New(fmt.Sprintf("variadic func must declare at least one param: %s", name))
+	}
+
+	e.mu.Lock()
+	e.funcs[name] = fn
+	e.mu.Unlock()
+	return nil
+}
+
+// funcName checks that name can be lexed as a function name and adds the
+// leading $ if it is missing.
+func funcName(name string) (string, error) {
+	if !strings.HasPrefix(name, "$") {
+		name = "$" + name
+	}
+
+	if len(name) == 1 {
+		return "", errors.New("func name is empty")
+	}
+
+	for _, r := range name[1:] {
+		switch getIdent(r) {
+		case CONST, RESERVED:
+		default:
+			return "", errors.New(fmt.Sprintf("invalid func name: %s", name))
+		}
+	}
+
+	return name, nil
+}
+
+func (e *Env) lookup(name string) *Func {
+	for ; e != nil; e = e.parent {
+		e.mu.RLock()
+		f, ok := e.funcs[name]
+		e.mu.RUnlock()
+		if ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// callFunc evaluates the arguments of a call and passes them to f. TypeExpr
+// arguments are wrapped in a *Lambda instead of being evaluated.
+func callFunc(f *Func, name string, t *TokenTree, msg BMsg, sc *scope) (interface{}, error) {
+	args := make([]interface{}, len(t.Tokens))
+	for i, arg := range t.Tokens {
+		param := f.param(i)
+
+		if param == TypeExpr {
+			l := &Lambda{
+				tree: arg,
+				vars: f.Vars,
+				sc:   sc,
+			}
+			if arg.Type == LAMBDA {
+				l.tree = arg.Tokens[0]
+				l.param = arg.Value.(string)
+			}
+			args[i] = l
+			continue
+		}
+
+		v, err := eval(arg, msg, sc)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkArg(name, i, arg, param, v); err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	return funcResult(f, name, t, args)
+}
+
+// checkArg checks the value v of argument i against its declared type
+func checkArg(name string, i int, arg *TokenTree, param Type, v interface{}) error {
+	if param != TypeAny && typeOf(v) != param {
+		err := typeError(arg, v, "argument %d must be %s, got: %s", i+1, param, reflect.TypeOf(v))
+		err.Func = name
+		return err
+	}
+	return nil
+}
+
+// funcResult calls f with args, turning any error into an *EvalError that
+// names the function and points at the call t.
+func funcResult(f *Func, name string, t *TokenTree, args []interface{}) (interface{}, error) {
+	f.numberArgs(args)
+	r, err := callFn(f, args)
+	if err != nil {
+		ee, ok := err.(*EvalError)
+		if !ok {
+			return nil, &EvalError{
+				Kind: FuncError,
+				Func: name,
+				Pos:  t.Pos,
+				Msg:  err.Error(),
+				Err:  err,
+			}
+		}
+
+		// errors from the function itself have no position yet. Copy
+		// the error so that one returned twice is not modified.
+		c := *ee
+		if c.Func == "" {
+			c.Func = name
+		}
+		if !c.Pos.IsValid() {
+			c.Pos = t.Pos
+		}
+		return nil, &c
+	}
+	return r, nil
+}
+
+// callFn calls the implementation of f, turning a panic into a PanicError.
+func callFn(f *Func, args []interface{}) (r interface{}, err error) {
+	defer recoverEval(&err)
+	return f.Fn(args)
+}
+
+// staticType returns the type a tree always evaluates to, or TypeAny if it
+// cannot be known before evaluation.
+func staticType(t *TokenTree) Type {
+	switch t.Type {
+	case CONST:
+		return TypeNumber
+	case D_STR, S_STR:
+		return TypeString
+	case RESERVED:
+		return typeOf(t.Value)
+	case ARRAY:
+		return TypeArray
+	case OBJECT:
+		return TypeObject
+	case OP:
+		switch t.Value {
+		case "==", "!=", ">", ">=", "<", "<=", "&&", "||", "!":
+			return TypeBool
+		case "-", "*", "/":
+			return TypeNumber
+		case "+":
+			a, b := staticType(t.Tokens[0]), staticType(t.Tokens[1])
+			if a == b {
+				return a
+			}
+		}
+	}
+	return TypeAny
+}
+
+// resolveFuncs checks every call in a tree against the functions in e and
+// adds the functions that are called to funcs, by name.
+func (e *Env) resolveFuncs(t *TokenTree, funcs map[string]*Func) error {
+	var f *Func
+
+	if t.Type == FUNC {
+		name := t.Value.(string)
+		f = e.lookup(name)
+		if f == nil {
+			return &CompileError{Pos: t.Pos, Msg: fmt.Sprintf("func does not exist: %s", name)}
+		}
+
+		if !f.acceptsArgs(len(t.Tokens)) {
+			return &CompileError{Pos: t.Pos, Msg: fmt.Sprintf("wrong num of arguments for %s: %d", name, len(t.Tokens))}
+		}
+
+		for i, arg := range t.Tokens {
+			param := f.param(i)
+			if param == TypeAny || param == TypeExpr {
+				continue
+			}
+
+			if st := staticType(arg); st != TypeAny && st != param {
+				return &CompileError{Pos: arg.Pos, Msg: fmt.Sprintf("argument %d of %s must be %s, got: %s", i+1, name, param, st)}
+			}
+		}
+
+		funcs[name] = f
+	}
+
+	for i, sub := range t.Tokens {
+		if sub.Type == LAMBDA && (f == nil || f.param(i) != TypeExpr) {
+			return &CompileError{Pos: sub.Pos, Msg: fmt.Sprintf("%s -> can only be used as an argument to a function that takes an expression", sub.Value)}
+		}
+
+		if err := e.resolveFuncs(sub, funcs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package jee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testFuncsOnce sync.Once
+
+// registerTestFuncs registers $concat, $clamp and $sumBy in the global
+// registry. Every test that calls them, directly or through a shared table,
+// calls it first.
+func registerTestFuncs() {
+	testFuncsOnce.Do(func() {
+		RegisterFunc("concat", &Func{
+			Params:   []Type{TypeString},
+			Variadic: true,
+			Fn: func(args []interface{}) (interface{}, error) {
+				s := ""
+				for _, a := range args {
+					s += a.(string)
+				}
+				return s, nil
+			},
+		})
+
+		RegisterFunc("$clamp", &Func{
+			Params: []Type{TypeNumber, TypeNumber, TypeNumber},
+			Fn: func(args []interface{}) (interface{}, error) {
+				x, lo, hi := args[0].(float64), args[1].(float64), args[2].(float64)
+				if x < lo {
+					return lo, nil
+				}
+				if x > hi {
+					return hi, nil
+				}
+				return x, nil
+			},
+		})
+
+		RegisterFunc("sumBy", &Func{
+			Params: []Type{TypeArray, TypeExpr},
+			Vars:   []string{"$index"},
+			Fn: func(args []interface{}) (interface{}, error) {
+				f := args[1].(*Lambda)
+				sum := 0.0
+				for i, e := range args[0].([]interface{}) {
+					v, err := f.Call(e, float64(i))
+					if err != nil {
+						return nil, err
+					}
+					n, ok := v.(float64)
+					if !ok {
+						return nil, errors.New("sumBy expression must return a number")
+					}
+					sum += n
+				}
+				return sum, nil
+			},
+		})
+	})
+}
+
+func TestRegisterFunc(t *testing.T) {
+	registerTestFuncs()
+
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+
+	tests := []Test{
+		Test{exp: `$concat()`, result: `""`},
+		Test{exp: `$concat("a")`, result: `"a"`},
+		Test{exp: `$concat("<", .string, ">", $str(.int))`, result: `"<hello world>5"`},
+		Test{exp: `$clamp(.int, 0, 3)`, result: `3`},
+		Test{exp: `$clamp(-.int, 0, 3)`, result: `0`},
+		Test{exp: `$sumBy(.arrayObj, .val)`, result: `14.5`},
+		Test{exp: `$sumBy(.arrayInt, $index)`, result: `45`},
+		Test{exp: `$sumBy(.arrayObj, $o -> $o.val * $index)`, result: `22.5`},
+	}
+
+	for _, test := range tests {
+		e, err := Compile(test.exp)
+		if err != nil {
+			t.Error("failed compile", test.exp, err)
+			continue
+		}
+
+		result, err := e.Eval(umsg)
+		if err != nil {
+			t.Error("failed eval", test.exp, err)
+			continue
+		}
+
+		var rmsg BMsg
+		json.Unmarshal([]byte(test.result), &rmsg)
+		if !reflect.DeepEqual(rmsg, result) {
+			t.Error(test.exp, "expected", rmsg, "got", result)
+		}
+	}
+}
+
+func TestCompileChecksFuncs(t *testing.T) {
+	registerTestFuncs()
+
+	for _, exp := range []string{
+		`$nope(1)`,
+		`$clamp(1, 2)`,
+		`$clamp(1, 2, 3, 4)`,
+		`$clamp("1", 2, 3)`,
+		`$clamp(1, 2, .a == 1)`,
+		`$clamp(1, 2, [3])`,
+		`$concat("a", 1)`,
+		`$concat("a" + "b", 1 + 2)`,
+		`$sumBy([1])`,
+		`$abs($x -> $x)`,
+		`$pow(1)`,
+	} {
+		if _, err := Compile(exp); err == nil {
+			t.Error("expected compile error for", exp)
+		}
+	}
+}
+
+func TestFuncRuntimeTypes(t *testing.T) {
+	registerTestFuncs()
+
+	for _, exp := range []string{
+		`$clamp(.string, 0, 1)`,
+		`$concat("a", .int)`,
+		`$sumBy(.string, .)`,
+		`$sumBy(.arrayObj, .name)`,
+	} {
+		e, err := Compile(exp)
+		if err != nil {
+			t.Error("failed compile", exp, err)
+			continue
+		}
+
+		if _, err := e.Eval(map[string]interface{}{"string": "s", "int": 1.0, "arrayObj": []interface{}{map[string]interface{}{"name": "a"}}}); err == nil {
+			t.Error("expected eval error for", exp)
+		}
+	}
+}
+
+func TestFuncNumberArgs(t *testing.T) {
+	registerTestFuncs()
+
+	typeName := func(args []interface{}) (interface{}, error) {
+		return fmt.Sprintf("%T", args[0]), nil
+	}
+	floats := &Func{Params: []Type{TypeNumber}, Fn: typeName}
+	exact := &Func{Params: []Type{TypeNumber}, ExactNumbers: true, Fn: typeName}
+
+	huge, _ := new(big.Int).SetString("100000000000000000000", 10)
+	msg := map[string]interface{}{"int": int64(1<<53 + 1), "big": huge, "float": 1.5}
+
+	tests := []struct {
+		exp    string
+		result interface{}
+	}{
+		{`$clamp(.int, 0, 10)`, 10.0},
+		{`$clamp(0, .big, .int)`, 1e20},
+		{`$floats(.int)`, "float64"},
+		{`$floats(.big)`, "float64"},
+		{`$floats(.float)`, "float64"},
+		{`$exact(.int)`, "int64"},
+		{`$exact(.big)`, "*big.Int"},
+		{`$exact(.float)`, "float64"},
+	}
+
+	for _, test := range tests {
+		e, err := Compile(test.exp, WithFunc("floats", floats), WithFunc("exact", exact))
+		if err != nil {
+			t.Error("failed compile", test.exp, err)
+			continue
+		}
+		checkSameEval(t, e, msg, nil)
+
+		result, err := e.Eval(msg)
+		if err != nil || result != test.result {
+			t.Errorf("%s: expected %v, got %v %v", test.exp, test.result, result, err)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	registerTestFuncs()
+
+	triple := &Func{
+		Params: []Type{TypeNumber},
+		Fn: func(args []interface{}) (interface{}, error) {
+			return args[0].(float64) * 3, nil
+		},
+	}
+
+	env := NewEnv()
+	if err := env.RegisterFunc("triple", triple); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := env.Compile(`$triple($abs(-2)) + $clamp(10, 0, 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := e.Eval(nil); r != 7.0 {
+		t.Error("expected 7, got", r)
+	}
+
+	if _, err := Compile(`$triple(1)`); err == nil {
+		t.Error("func registered on an Env leaked into the global registry")
+	}
+
+	e, err = Compile(`$triple(2)`, WithFunc("$triple", triple))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := e.Eval(nil); r != 6.0 {
+		t.Error("expected 6, got", r)
+	}
+
+	// an Env can shadow a built-in function
+	env.RegisterFunc("abs", triple)
+	e, _ = env.Compile(`$abs(-2)`)
+	if r, _ := e.Eval(nil); r != -6.0 {
+		t.Error("expected -6, got", r)
+	}
+	e, _ = Compile(`$abs(-2)`)
+	if r, _ := e.Eval(nil); r != 2.0 {
+		t.Error("expected 2, got", r)
+	}
+}
+
+func TestRegisterFuncErrors(t *testing.T) {
+	fn := func(args []interface{}) (interface{}, error) { return nil, nil }
+
+	for name, f := range map[string]*Func{
+		"":        &Func{Fn: fn},
+		"$":       &Func{Fn: fn},
+		"a b":     &Func{Fn: fn},
+		"a.b":     &Func{Fn: fn},
+		"noFn":    &Func{},
+		"vararg":  &Func{Variadic: true, Fn: fn},
+		"nilFunc": nil,
+	} {
+		if err := RegisterFunc(name, f); err == nil {
+			t.Error("expected error registering", name)
+		}
+	}
+
+	_, err := Compile(`1`, WithFunc("a b", &Func{Fn: fn}))
+	if err == nil || !strings.Contains(err.Error(), "invalid func name") {
+		t.Error("expected invalid func name error, got", err)
+	}
+}
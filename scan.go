@@ -0,0 +1,411 @@
+package jee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"unicode/utf8"
+)
+
+// EvalBytes evaluates the JSON document data against a tree generated by
+// Parser. Only the members and elements of data the query can read are
+// decoded; the rest are scanned over without being decoded, so a query like
+// .meta.id is cheap on a large document. The result is the same as
+// unmarshalling data with json.Unmarshal and calling Eval.
+func EvalBytes(t *TokenTree, data []byte) (interface{}, error) {
+	msg, err := decodeProjected(data, project(t, nil), false)
+	if err != nil {
+		return nil, err
+	}
+	return Eval(t, msg)
+}
+
+// EvalBytes evaluates the JSON document data against the expression,
+// decoding only what the expression can read. See EvalBytes and
+// WithUseNumber.
+func (e *Expression) EvalBytes(data []byte) (interface{}, error) {
+	msg, err := decodeProjected(data, e.proj, e.useNumber)
+	if err != nil {
+		return nil, err
+	}
+	return e.Eval(msg)
+}
+
+// EvalBytesWithVars is like EvalBytes but binds the external variables
+// referenced as @name in the query to vars.
+func (e *Expression) EvalBytesWithVars(data []byte, vars map[string]interface{}) (interface{}, error) {
+	msg, err := decodeProjected(data, e.proj, e.useNumber)
+	if err != nil {
+		return nil, err
+	}
+	return e.EvalWithVars(msg, vars)
+}
+
+// json.Unmarshal refuses documents nested deeper than this
+const maxDepth = 10000
+
+// whole is the projection of a value that is decoded completely
+var whole = &projection{all: true}
+
+// scanner decodes a JSON document, or the parts of it in a projection.
+// Skipped values are checked to be well formed but are not decoded, so a
+// skipped number too large for a float64 is not an error.
+type scanner struct {
+	data      []byte
+	i         int
+	depth     int
+	useNumber bool
+}
+
+// decodeProjected decodes the parts of data in p into the types given by
+// json.Unmarshal. Objects keep only the members in p and arrays without
+// elements in p are decoded empty. With useNumber, numbers are decoded as
+// json.Number.
+func decodeProjected(data []byte, p *projection, useNumber bool) (interface{}, error) {
+	s := &scanner{data: data, useNumber: useNumber}
+	v, err := s.value(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s.space()
+	if s.i < len(s.data) {
+		return nil, s.errorf("invalid character %q after top-level value", s.data[s.i])
+	}
+	return v, nil
+}
+
+func (s *scanner) errorf(format string, a ...interface{}) error {
+	return errors.New(fmt.Sprintf("invalid JSON at offset %d: %s", s.i, fmt.Sprintf(format, a...)))
+}
+
+func (s *scanner) space() {
+	for s.i < len(s.data) {
+		switch s.data[s.i] {
+		case ' ', '\t', '\n', '\r':
+			s.i++
+		default:
+			return
+		}
+	}
+}
+
+// next skips whitespace and returns the next byte, or 0 at the end
+func (s *scanner) next() byte {
+	s.space()
+	if s.i < len(s.data) {
+		return s.data[s.i]
+	}
+	return 0
+}
+
+func (s *scanner) expect(c byte) error {
+	if s.next() != c {
+		return s.unexpected()
+	}
+	s.i++
+	return nil
+}
+
+func (s *scanner) unexpected() error {
+	if s.i >= len(s.data) {
+		return s.errorf("unexpected end of JSON input")
+	}
+	return s.errorf("invalid character %q", s.data[s.i])
+}
+
+// value decodes the next value as far as p reads it. If p is nil the value
+// is skipped and nil is returned.
+func (s *scanner) value(p *projection) (interface{}, error) {
+	switch s.next() {
+	case '{':
+		return s.object(p)
+	case '[':
+		return s.array(p)
+	case '"':
+		if p == nil {
+			return nil, s.skipString()
+		}
+		return s.str()
+	case 't':
+		return true, s.literal("true")
+	case 'f':
+		return false, s.literal("false")
+	case 'n':
+		return nil, s.literal("null")
+	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return s.number(p == nil)
+	}
+	return nil, s.unexpected()
+}
+
+func (s *scanner) nest() error {
+	s.depth++
+	if s.depth > maxDepth {
+		return s.errorf("exceeded max depth")
+	}
+	return nil
+}
+
+func (s *scanner) object(p *projection) (interface{}, error) {
+	if err := s.nest(); err != nil {
+		return nil, err
+	}
+	s.i++
+
+	var obj map[string]interface{}
+	if p != nil {
+		obj = map[string]interface{}{}
+	}
+
+	if s.next() == '}' {
+		s.i++
+		s.depth--
+		return obj, nil
+	}
+
+	for {
+		if s.next() != '"' {
+			return nil, s.unexpected()
+		}
+
+		var key []byte
+		var err error
+		if p == nil {
+			err = s.skipString()
+		} else {
+			key, err = s.key()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.expect(':'); err != nil {
+			return nil, err
+		}
+
+		var sub *projection
+		if p != nil && p.all {
+			sub = whole
+		} else if p != nil {
+			// looking a key up does not copy it
+			sub = p.fields[string(key)]
+		}
+
+		v, err := s.value(sub)
+		if err != nil {
+			return nil, err
+		}
+		if sub != nil {
+			obj[string(key)] = v
+		}
+
+		switch s.next() {
+		case ',':
+			s.i++
+		case '}':
+			s.i++
+			s.depth--
+			return obj, nil
+		default:
+			return nil, s.unexpected()
+		}
+	}
+}
+
+func (s *scanner) array(p *projection) (interface{}, error) {
+	if err := s.nest(); err != nil {
+		return nil, err
+	}
+	s.i++
+
+	var sub *projection
+	var arr []interface{}
+	if p != nil {
+		sub = p.elems
+		if p.all {
+			sub = whole
+		}
+		arr = []interface{}{}
+	}
+
+	if s.next() == ']' {
+		s.i++
+		s.depth--
+		return arr, nil
+	}
+
+	for {
+		v, err := s.value(sub)
+		if err != nil {
+			return nil, err
+		}
+		if sub != nil {
+			arr = append(arr, v)
+		}
+
+		switch s.next() {
+		case ',':
+			s.i++
+		case ']':
+			s.i++
+			s.depth--
+			return arr, nil
+		default:
+			return nil, s.unexpected()
+		}
+	}
+}
+
+func (s *scanner) str() (string, error) {
+	b, err := s.key()
+	return string(b), err
+}
+
+// key decodes a string without copying it if it has no escapes. Strings with
+// escapes or invalid UTF-8 are decoded by json.Unmarshal, so that they decode
+// the same way.
+func (s *scanner) key() ([]byte, error) {
+	start := s.i
+	s.i++
+
+	var nonASCII bool
+	for s.i < len(s.data) {
+		c := s.data[s.i]
+		switch {
+		case c == '"':
+			s.i++
+			b := s.data[start+1 : s.i-1]
+			if nonASCII && !utf8.Valid(b) {
+				return s.unmarshalString(start)
+			}
+			return b, nil
+		case c == '\\' || c < 0x20:
+			return s.unmarshalString(start)
+		case c >= 0x80:
+			nonASCII = true
+		}
+		s.i++
+	}
+	return nil, s.unexpected()
+}
+
+func (s *scanner) unmarshalString(start int) ([]byte, error) {
+	s.i = start
+	if err := s.skipString(); err != nil {
+		return nil, err
+	}
+
+	var v string
+	err := json.Unmarshal(s.data[start:s.i], &v)
+	return []byte(v), err
+}
+
+func (s *scanner) skipString() error {
+	s.i++
+	for s.i < len(s.data) {
+		c := s.data[s.i]
+		switch {
+		case c == '"':
+			s.i++
+			return nil
+		case c == '\\':
+			s.i++
+			if s.i >= len(s.data) {
+				return s.unexpected()
+			}
+			switch s.data[s.i] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				for j := 1; j <= 4; j++ {
+					if s.i+j >= len(s.data) || !isHex(s.data[s.i+j]) {
+						s.i += j
+						return s.unexpected()
+					}
+				}
+				s.i += 4
+			default:
+				return s.errorf("invalid escape %q in string", s.data[s.i])
+			}
+		case c < 0x20:
+			return s.errorf("invalid character %q in string", c)
+		}
+		s.i++
+	}
+	return s.unexpected()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func (s *scanner) literal(lit string) error {
+	if len(s.data)-s.i < len(lit) || string(s.data[s.i:s.i+len(lit)]) != lit {
+		for j := 0; j < len(lit) && s.i < len(s.data) && s.data[s.i] == lit[j]; j++ {
+			s.i++
+		}
+		return s.unexpected()
+	}
+	s.i += len(lit)
+	return nil
+}
+
+// digits skips a run of digits and reports whether there was at least one
+func (s *scanner) digits() bool {
+	start := s.i
+	for s.i < len(s.data) && isDigit(s.data[s.i]) {
+		s.i++
+	}
+	return s.i > start
+}
+
+// number scans a number, which is decoded unless skip is set
+func (s *scanner) number(skip bool) (interface{}, error) {
+	start := s.i
+	if s.data[s.i] == '-' {
+		s.i++
+	}
+
+	if s.i < len(s.data) && s.data[s.i] == '0' {
+		s.i++
+	} else if !s.digits() {
+		return nil, s.unexpected()
+	}
+
+	if s.i < len(s.data) && s.data[s.i] == '.' {
+		s.i++
+		if !s.digits() {
+			return nil, s.unexpected()
+		}
+	}
+
+	if s.i < len(s.data) && (s.data[s.i] == 'e' || s.data[s.i] == 'E') {
+		s.i++
+		if s.i < len(s.data) && (s.data[s.i] == '+' || s.data[s.i] == '-') {
+			s.i++
+		}
+		if !s.digits() {
+			return nil, s.unexpected()
+		}
+	}
+
+	if skip {
+		return nil, nil
+	}
+
+	lit := string(s.data[start:s.i])
+	if s.useNumber {
+		return json.Number(lit), nil
+	}
+	f, err := strconv.ParseFloat(lit, 64)
+	if err != nil {
+		return nil, &json.UnmarshalTypeError{Value: "number " + lit, Type: reflect.TypeOf(f), Offset: int64(s.i)}
+	}
+	return f, nil
+}
@@ -0,0 +1,241 @@
+package jee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkSameEvalBytes checks that e evaluates data to what it evaluates the
+// fully unmarshalled data to
+func checkSameEvalBytes(t *testing.T, e *Expression, data []byte, vars map[string]interface{}) {
+	var msg interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, expectedErr := e.EvalWithVars(msg, vars)
+	result, err := e.EvalBytesWithVars(data, vars)
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("%s: expected error %v, got %v", e, expectedErr, err)
+		return
+	}
+	if fmt.Sprintf("%#v", expected) != fmt.Sprintf("%#v", result) {
+		t.Errorf("%s: expected %#v, got %#v", e, expected, result)
+	}
+}
+
+func TestEvalBytesSameResults(t *testing.T) {
+	testFile, _ := ioutil.ReadFile("test.json")
+
+	vars := map[string]interface{}{"a": []interface{}{1.0, "x", nil}, "b": 1.0, "x": "int"}
+
+	for _, exp := range allQueries() {
+		e, err := Compile(exp)
+		if err != nil {
+			continue
+		}
+		checkSameEvalBytes(t, e, testFile, vars)
+	}
+
+	tree := parseString(t, `.arrayObj[? .val > 2].nested[].id`)
+	r, err := EvalBytes(tree, testFile)
+	if err != nil || !reflect.DeepEqual(r, []interface{}{"zof", "zif"}) {
+		t.Error("expected [zof zif], got", r, err)
+	}
+}
+
+// TestEvalBytesRandomTrees checks EvalBytes against json.Unmarshal and Eval
+// on the random trees of TestVMRandomTrees.
+func TestEvalBytesRandomTrees(t *testing.T) {
+	funcs := map[string]*Func{
+		"$f": &Func{
+			Params:   []Type{TypeAny, TypeExpr},
+			Variadic: true,
+			Fn: func(args []interface{}) (interface{}, error) {
+				out := []interface{}{args[0]}
+				for _, arg := range args[1:] {
+					r, err := arg.(*Lambda).Call(args[0])
+					if err != nil {
+						return nil, err
+					}
+					out = append(out, r)
+				}
+				return out, nil
+			},
+		},
+		"$g": &Func{
+			Params:   []Type{TypeAny},
+			Variadic: true,
+			Fn: func(args []interface{}) (interface{}, error) {
+				return args, nil
+			},
+		},
+	}
+
+	data := []byte(`{"a": [1, {"b1": 2, "a": "x"}, "x", [true, {"if": 1}]], "b1": {"a": true, "_c": [0, 1], "if": {"true": "b1"}}, "_c": null, "true": 3, "if": [[1, 2], [3, {"a": []}]]}`)
+	vars := map[string]interface{}{"a": 1, "b1": []interface{}{2.0, "b1"}, "_c": "a"}
+
+	g := &treeGen{r: rand.New(rand.NewSource(3))}
+	for i := 0; i < 20000; i++ {
+		tree := newTree(Position{}, ZERO, nil, g.expr(1+i%6))
+		e := &Expression{
+			source: tree.String(),
+			tree:   tree,
+			funcs:  funcs,
+			prog:   compileProgram(tree, funcs),
+			proj:   project(tree, funcs),
+		}
+		checkSameEvalBytes(t, e, data, vars)
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+var decodeTests = []string{
+	`null`, ` true `, `false`, `0`, `-0`, `1.5e3`, `-12.25E-2`, `1e400`,
+	`""`, `"a\"b\\c\/d\b\f\n\r\t"`, `"é😀"`, `"\ud800"`, "\"caf\xc3\xa9\"", "\"\xff\"",
+	`[]`, `[1, [2, [3]], {}]`, `{"a": {"b": [1, 2]}, "a": 3}`, `{"a": 1}`,
+	``, ` `, `[1,]`, `{"a" 1}`, `{"a": 1,}`, `[1 2]`, `01`, `1.`, `-`, `1e`, `tru`, `nul`,
+	`"a`, "\"a\nb\"", `"\x"`, `"\u12"`, `{1: 2}`, `[1] [2]`, `[`, `{`, `{"a":`,
+}
+
+func TestDecodeWhole(t *testing.T) {
+	for _, doc := range decodeTests {
+		checkDecodeWhole(t, doc)
+	}
+
+	deep := strings.Repeat("[", maxDepth+1) + strings.Repeat("]", maxDepth+1)
+	if _, err := decodeProjected([]byte(deep), whole, false); err == nil {
+		t.Error("expected an error for a document nested too deep")
+	}
+}
+
+// checkDecodeWhole checks that decoding a whole document gives what
+// json.Unmarshal gives
+func checkDecodeWhole(t *testing.T, doc string) {
+	var expected interface{}
+	expectedErr := json.Unmarshal([]byte(doc), &expected)
+
+	v, err := decodeProjected([]byte(doc), whole, false)
+	if (expectedErr == nil) != (err == nil) {
+		t.Errorf("%q: expected error %v, got %v", doc, expectedErr, err)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if !reflect.DeepEqual(expected, v) {
+		t.Errorf("%q: expected %#v, got %#v", doc, expected, v)
+	}
+
+	// and with numbers as json.Number, what a json.Decoder with UseNumber
+	// gives
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	dec.Decode(&expected)
+	v, err = decodeProjected([]byte(doc), whole, true)
+	if err != nil || !reflect.DeepEqual(expected, v) {
+		t.Errorf("%q: expected %#v with UseNumber, got %#v %v", doc, expected, v, err)
+	}
+}
+
+func TestDecodeSkipped(t *testing.T) {
+	// skipped values are not decoded but must be well formed
+	p := &projection{fields: map[string]*projection{"a": whole}}
+	for doc, ok := range map[string]bool{
+		`{"a": 1, "b": {"c": [1, "é", null]}}`: true,
+		`{"b": 1e400, "a": 1}`:                 true,
+		`{"a": 1, "b": [1, }`:                  false,
+		`{"a": 1, "b": "\q"}`:                  false,
+		`{"a": 1, "b": tru}`:                   false,
+		`{"a": 1, "b": 01}`:                    false,
+	} {
+		_, err := decodeProjected([]byte(doc), p, false)
+		if ok != (err == nil) {
+			t.Errorf("%s: expected ok %v, got %v", doc, ok, err)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, doc := range decodeTests {
+		f.Add(doc)
+	}
+
+	f.Fuzz(func(t *testing.T, doc string) {
+		checkDecodeWhole(t, doc)
+	})
+}
+
+// largeDocument returns test.json with its arrays repeated n times
+func largeDocument(n int) []byte {
+	var msg map[string]interface{}
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &msg)
+
+	for key, value := range msg {
+		if arr, ok := value.([]interface{}); ok {
+			var large []interface{}
+			for i := 0; i < n; i++ {
+				large = append(large, arr...)
+			}
+			msg[key] = large
+		}
+	}
+
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+func benchmarkUnmarshalEval(b *testing.B, query string) {
+	data := largeDocument(1000)
+	e := MustCompile(query)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var msg interface{}
+		json.Unmarshal(data, &msg)
+		e.Eval(msg)
+	}
+}
+
+func benchmarkEvalBytes(b *testing.B, query string) {
+	data := largeDocument(1000)
+	e := MustCompile(query)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvalBytes(data)
+	}
+}
+
+func BenchmarkUnmarshalEvalKey(b *testing.B) {
+	benchmarkUnmarshalEval(b, `.a.b.c[0].d.e`)
+}
+
+func BenchmarkEvalBytesKey(b *testing.B) {
+	benchmarkEvalBytes(b, `.a.b.c[0].d.e`)
+}
+
+func BenchmarkUnmarshalEvalFilter(b *testing.B) {
+	benchmarkUnmarshalEval(b, `$len(.arrayObj[? .val > 2].nested[].id)`)
+}
+
+func BenchmarkEvalBytesFilter(b *testing.B) {
+	benchmarkEvalBytes(b, `$len(.arrayObj[? .val > 2].nested[].id)`)
+}
+
+func BenchmarkUnmarshalEvalWhole(b *testing.B) {
+	benchmarkUnmarshalEval(b, `$len($keys(.))`)
+}
+
+func BenchmarkEvalBytesWhole(b *testing.B) {
+	benchmarkEvalBytes(b, `$len($keys(.))`)
+}
@@ -0,0 +1,541 @@
+package jee
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages and external variables may be any Go value, not only the types
+// given by json.Unmarshal. Keys and indices are applied to structs, maps and
+// slices by reflection, and the values an expression works with are
+// converted the way encoding/json would marshal them:
+//
+//   - numbers become float64, except integers that a float64 cannot hold
+//     exactly, which become int64 or *big.Int, see number. A json.Number is
+//     converted the same way.
+//   - exported struct fields are members named by their json tag, or their
+//     name if they have none, fields tagged "-" are left out and so are
+//     empty fields tagged omitempty
+//   - maps with string or integer keys become objects
+//   - slices and arrays become arrays, except []byte, which becomes a base64
+//     string
+//   - a time.Time becomes milliseconds since the epoch, like $now
+//   - nil pointers, maps and slices become null
+//
+// Only the values an expression reaches are converted, so a query like
+// .user.id does not convert the rest of the message.
+
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	numberType = reflect.TypeOf(json.Number(""))
+	bigIntType = reflect.TypeOf(big.Int{})
+)
+
+var errTooDeep = errors.New("value nested too deep to convert, it may contain a cycle")
+
+// toValue converts v to the types given by json.Unmarshal. The members of a
+// map[string]interface{} or []interface{} are converted when they are
+// accessed.
+func toValue(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, float64, string, bool, map[string]interface{}, []interface{}:
+		return v, nil
+	case int64, *big.Int, json.Number:
+		return convertNumber(v)
+	}
+	return convert(reflect.ValueOf(v), 0)
+}
+
+func convert(rv reflect.Value, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+	depth++
+
+	switch rv.Type() {
+	case numberType:
+		return convertNumber(json.Number(rv.String()))
+	case bigIntType:
+		i := rv.Interface().(big.Int)
+		return normalizeInt(new(big.Int).Set(&i)), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return convertNumber(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := rv.Uint(); u > math.MaxInt64 {
+			return new(big.Int).SetUint64(u), nil
+		}
+		return convertNumber(int64(rv.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return convert(rv.Elem(), depth)
+	case reflect.Struct:
+		if rv.Type() == timeType {
+			t := rv.Interface().(time.Time)
+			return float64(t.UnixNano() / 1000 / 1000), nil
+		}
+
+		fields := structFields(rv.Type())
+		obj := make(map[string]interface{}, len(fields.list))
+		for _, f := range fields.list {
+			fv, ok := fieldByIndex(rv, f.index)
+			if !ok || f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+			v, err := convert(fv, depth)
+			if err != nil {
+				return nil, err
+			}
+			obj[f.name] = v
+		}
+		return obj, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil, nil
+		}
+
+		obj := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, ok := mapKeyString(iter.Key())
+			if !ok {
+				return rv.Interface(), nil
+			}
+			v, err := convert(iter.Value(), depth)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = v
+		}
+		return obj, nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, nil
+		}
+		if isBytes(rv) {
+			return base64.StdEncoding.EncodeToString(rv.Bytes()), nil
+		}
+
+		arr := make([]interface{}, rv.Len())
+		for i := range arr {
+			v, err := convert(rv.Index(i), depth)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	case reflect.Invalid:
+		return nil, nil
+	}
+
+	// channels, funcs and complex numbers have no JSON equivalent and
+	// fail any operator they are used with
+	return rv.Interface(), nil
+}
+
+func convertNumber(v interface{}) (interface{}, error) {
+	n, ok := number(v)
+	if !ok {
+		return nil, fmt.Errorf("invalid number: %v", v)
+	}
+	return n, nil
+}
+
+// member returns the member name of v, which must be a struct or a map with
+// string or integer keys, or a pointer to one. The member is not converted,
+// but is nil if it is null.
+func member(v interface{}, name string) (interface{}, bool) {
+	rv := indirect(reflect.ValueOf(v))
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		if rv.Type() == timeType || rv.Type() == bigIntType {
+			return nil, false
+		}
+		f, ok := structFields(rv.Type()).byName[name]
+		if !ok {
+			return nil, true
+		}
+		fv, ok := fieldByIndex(rv, f.index)
+		if !ok || f.omitEmpty && isEmpty(fv) {
+			return nil, true
+		}
+		return orNil(fv.Interface()), true
+	case reflect.Map:
+		key, ok := mapKey(rv.Type().Key(), name)
+		if !ok {
+			_, isObject := mapKeyString(reflect.Zero(rv.Type().Key()))
+			return nil, isObject
+		}
+		mv := rv.MapIndex(key)
+		if !mv.IsValid() {
+			return nil, true
+		}
+		return orNil(mv.Interface()), true
+	}
+	return nil, false
+}
+
+// elements returns the elements of v, which must be a slice or an array
+// other than []byte, or a pointer to one. The elements are not converted,
+// but are nil if they are null.
+func elements(v interface{}) ([]interface{}, bool) {
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array || isBytes(rv) {
+		return nil, false
+	}
+
+	arr := make([]interface{}, rv.Len())
+	for i := range arr {
+		arr[i] = orNil(rv.Index(i).Interface())
+	}
+	return arr, true
+}
+
+// index returns element i of v, which must be a slice or an array other
+// than []byte, or a pointer to one, or nil if i is out of range. The
+// element is not converted.
+func index(v interface{}, i float64) (interface{}, bool) {
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array || isBytes(rv) {
+		return nil, false
+	}
+
+	if !(i >= 0 && i < float64(rv.Len())) {
+		return nil, true
+	}
+	return orNil(rv.Index(int(i)).Interface()), true
+}
+
+// orNil returns nil for a nil pointer, map or slice, which are null, so
+// that they are skipped like nil by keys and indices
+func orNil(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, float64, string, bool, map[string]interface{}, []interface{}:
+		return v
+	}
+
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Map, reflect.Slice:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+	return v
+}
+
+// indirect follows pointers and interfaces. It returns the zero Value for a
+// nil pointer.
+func indirect(rv reflect.Value) reflect.Value {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+// isEmpty reports whether a field tagged omitempty is left out
+func isEmpty(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func isBytes(rv reflect.Value) bool {
+	return rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8
+}
+
+// mapKeyString returns a map key as the name of a member
+func mapKeyString(k reflect.Value) (string, bool) {
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), true
+	}
+	return "", false
+}
+
+// mapKey returns the map key of type t for the name of a member
+func mapKey(t reflect.Type, name string) (reflect.Value, bool) {
+	k := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		k.SetString(name)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(name, 10, t.Bits())
+		if err != nil {
+			return k, false
+		}
+		k.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(name, 10, t.Bits())
+		if err != nil {
+			return k, false
+		}
+		k.SetUint(n)
+	default:
+		return k, false
+	}
+	return k, true
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, but reports a nil embedded
+// pointer instead of panicking
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+type field struct {
+	name  string
+	index []int
+	// the field is left out when it is empty
+	omitEmpty bool
+}
+
+// fields are the members of a struct type
+type fields struct {
+	list   []field
+	byName map[string]field
+}
+
+// fieldCache holds the fields of every struct type seen, by reflect.Type
+var fieldCache sync.Map
+
+func structFields(t reflect.Type) *fields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*fields)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.(*fields)
+}
+
+// typeFields finds the members of a struct type the way encoding/json does.
+// The fields of embedded structs are promoted unless a field of the same
+// name is less deeply embedded. Of several fields of the same name at the
+// same depth, a tagged one wins; if there is none or more than one, the
+// name is left out.
+func typeFields(t reflect.Type) *fields {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+
+	f := &fields{byName: map[string]field{}}
+	// names taken by shallower fields, including conflicting ones
+	taken := map[string]bool{}
+	visited := map[reflect.Type]bool{}
+
+	current := []embedded{{t: t}}
+	for len(current) > 0 {
+		var next []embedded
+		var names []string
+		found := map[string][]field{}
+		tagged := map[string]int{}
+
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+
+			for i := 0; i < e.t.NumField(); i++ {
+				sf := e.t.Field(i)
+				index := append(append([]int{}, e.index...), i)
+
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts := tag, ""
+				if comma := strings.Index(tag, ","); comma >= 0 {
+					name, opts = tag[:comma], tag[comma:]
+				}
+
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{t: ft, index: index})
+					continue
+				}
+				if sf.PkgPath != "" {
+					// unexported
+					continue
+				}
+
+				if name != "" {
+					tagged[name]++
+				} else {
+					name = sf.Name
+				}
+				if _, ok := found[name]; !ok {
+					names = append(names, name)
+				}
+				found[name] = append(found[name], field{
+					name:      name,
+					index:     index,
+					omitEmpty: strings.Contains(opts+",", ",omitempty,"),
+				})
+			}
+		}
+
+		for _, name := range names {
+			if taken[name] {
+				continue
+			}
+			taken[name] = true
+
+			candidates := found[name]
+			if len(candidates) > 1 {
+				if tagged[name] != 1 {
+					continue
+				}
+				for _, c := range candidates {
+					if isTagged(t, c.index, name) {
+						candidates = []field{c}
+						break
+					}
+				}
+			}
+			f.list = append(f.list, candidates[0])
+			f.byName[name] = candidates[0]
+		}
+
+		current = next
+	}
+
+	return f
+}
+
+// isTagged reports whether the field of t at index is tagged with name
+func isTagged(t reflect.Type, index []int, name string) bool {
+	for i, x := range index {
+		if i > 0 && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if i == len(index)-1 {
+			tag := t.Field(x).Tag.Get("json")
+			return tag == name || strings.HasPrefix(tag, name+",")
+		}
+		t = t.Field(x).Type
+	}
+	return false
+}
+
+// memberOf returns member name of v, which may be any Go object
+func memberOf(t *TokenTree, v interface{}, name string) (interface{}, error) {
+	if m, ok := v.(map[string]interface{}); ok {
+		return orNil(m[name]), nil
+	}
+	r, ok := member(v, name)
+	if !ok {
+		return nil, typeError(t, errorValue(v), "could not assert to map")
+	}
+	return r, nil
+}
+
+// keyOf returns member name of v for the accessor t. The member of a value
+// that is not an object is null for .name, but an error for ["name"].
+func keyOf(t *TokenTree, v interface{}, name string) (interface{}, error) {
+	r, err := memberOf(t, v, name)
+	if err != nil && t.Type == KEY {
+		return nil, nil
+	}
+	return r, err
+}
+
+// elementsOf returns the elements of v, which may be any Go slice
+func elementsOf(t *TokenTree, v interface{}) ([]interface{}, error) {
+	if arr, ok := v.([]interface{}); ok {
+		return arr, nil
+	}
+	arr, ok := elements(v)
+	if !ok {
+		return nil, typeError(t, errorValue(v), "could not assert to slice")
+	}
+	return arr, nil
+}
+
+// indexOf returns element i of v, which may be any Go slice
+func indexOf(t *TokenTree, v interface{}, i float64) (interface{}, error) {
+	if arr, ok := v.([]interface{}); ok {
+		// compare as floats so that NaN and indices too large for an
+		// int are out of range
+		if !(i >= 0 && i < float64(len(arr))) {
+			return nil, nil
+		}
+		return orNil(arr[int(i)]), nil
+	}
+	r, ok := index(v, i)
+	if !ok {
+		return nil, typeError(t, errorValue(v), "could not assert to slice")
+	}
+	return r, nil
+}
+
+// convertAt converts the value of t with toValue
+func convertAt(t *TokenTree, v interface{}) (interface{}, error) {
+	r, err := toValue(v)
+	if err != nil {
+		return nil, evalError(t, TypeError, "%s", err)
+	}
+	return r, nil
+}
+
+// errorValue converts v for the Type of an error about it
+func errorValue(v interface{}) interface{} {
+	if r, err := toValue(v); err == nil {
+		return r
+	}
+	return v
+}
@@ -0,0 +1,255 @@
+package jee
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testAddress struct {
+	City string `json:"city"`
+	Zip  *int   `json:"zip"`
+}
+
+type testBase struct {
+	ID   int64  `json:"id"`
+	Kind string `json:"kind,omitempty"`
+}
+
+type testUser struct {
+	testBase
+	*testAddress
+	Name     string `json:"name"`
+	Email    string `json:"-"`
+	password string
+	Age      uint8
+	Score    float32           `json:"score"`
+	Tags     []string          `json:"tags"`
+	Home     *testAddress      `json:"home"`
+	Work     *testAddress      `json:"work"`
+	Friends  []*testUser       `json:"friends"`
+	Counts   map[string]int    `json:"counts"`
+	ByID     map[int16]string  `json:"byId"`
+	Grid     [2][2]int         `json:"grid"`
+	Data     []byte            `json:"data"`
+	Any      interface{}       `json:"any"`
+	Nothing  []int             `json:"nothing"`
+	Meta     map[string]*int64 `json:"meta"`
+}
+
+func testUserValue() *testUser {
+	zip := 10001
+	return &testUser{
+		testBase: testBase{ID: 7, Kind: "admin"},
+		Name:     "ann",
+		Email:    "ann@example.com",
+		password: "secret",
+		Age:      31,
+		Score:    2.5,
+		Tags:     []string{"a", "b"},
+		Home:     &testAddress{City: "nyc", Zip: &zip},
+		Friends: []*testUser{
+			{testBase: testBase{ID: 8}, Name: "bob", Age: 40},
+			nil,
+			{testBase: testBase{ID: 9}, Name: "cy", Age: 20, Tags: []string{"c"}},
+		},
+		Counts: map[string]int{"x": 1, "y": 2},
+		ByID:   map[int16]string{-3: "neg", 4: "four"},
+		Grid:   [2][2]int{{1, 2}, {3, 4}},
+		Data:   []byte("hi"),
+		Any:    []interface{}{uint(1), map[string]interface{}{"k": int8(2), "n": (*testUser)(nil)}, (*testUser)(nil)},
+		Meta:   map[string]*int64{"nil": nil},
+	}
+}
+
+var structQueries = []string{
+	`.`, `.id`, `.kind`, `.name`, `.Email`, `.password`, `.Age`, `.score`, `.city`,
+	`.tags`, `.tags[1]`, `.tags[5]`, `.tags[]`, `.home`, `.home.city`, `.home.zip + 1`,
+	`.work`, `.work.city`, `.friends[0].name`, `.friends[1].name`, `.friends[].id`,
+	`.friends[? . != null && .Age > 25].name`, `.friends[2].tags[0]`, `.friends[0].home.city`,
+	`.counts`, `.counts.y * 2`, `.counts.z`, `.counts["x"]`, `.byId["-3"]`, `.byId["4"]`,
+	`.byId.x`, `.grid`, `.grid[1][0]`, `.grid[][1]`, `$sum(.grid[0])`, `.data`, `.data[0]`,
+	`.any[1].k`, `.any[0] + 1`, `.any[1].n.name`, `.any[2].name`, `.any[][? . != null]`, `.any[].n`, `.nothing`, `.nothing[0]`, `.nothing[]`, `.meta.nil`,
+	`.meta.nil.x`, `$len($keys(.))`, `$len(.friends)`, `$has(.tags, "b")`,
+	`.name.x`, `.Age[0]`, `.tags.x`, `.friends[? .Age]`,
+	`.id == 7 && .Age > 30`, `[.id, .score]`, `{"n": .name, "c": .counts}`,
+	`let $f = .friends[2] in $f.name`, `.friends | .[0].Age`, `.friends[0].kind`,
+}
+
+// roundTrip marshals v and unmarshals it again
+func roundTrip(t *testing.T, v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// TestStructSameResults checks that evaluating Go values gives what
+// evaluating them marshalled to JSON and unmarshalled again gives.
+func TestStructSameResults(t *testing.T) {
+	user := testUserValue()
+	msg := roundTrip(t, user)
+
+	for _, exp := range structQueries {
+		e := MustCompile(exp)
+		checkSameEval(t, e, user, nil)
+
+		expected, expectedErr := e.Eval(msg)
+		result, err := e.Eval(user)
+		if !reflect.DeepEqual(expectedErr, err) {
+			t.Errorf("%s: expected error %v, got %v", exp, expectedErr, err)
+			continue
+		}
+		if fmt.Sprintf("%#v", expected) != fmt.Sprintf("%#v", result) {
+			t.Errorf("%s: expected %#v, got %#v", exp, expected, result)
+		}
+
+		// as an external variable
+		ext := MustCompile("@u | " + exp)
+		result, err = ext.EvalWithVars(nil, map[string]interface{}{"u": user})
+		if err == nil && fmt.Sprintf("%#v", expected) != fmt.Sprintf("%#v", result) {
+			t.Errorf("@u | %s: expected %#v, got %#v", exp, expected, result)
+		}
+	}
+}
+
+func TestStructFields(t *testing.T) {
+	type A struct{ X, Y int }
+	type B struct {
+		X int
+		Z int `json:"Y"`
+	}
+	type C struct {
+		A
+		B
+	}
+	type D struct {
+		A
+		B
+		X string
+	}
+	type E struct {
+		*A
+		W int `json:"w,omitempty"`
+		_ int
+	}
+
+	tests := []struct {
+		v      interface{}
+		result string
+	}{
+		{C{A{1, 2}, B{3, 4}}, `{"Y": 4}`},
+		{D{A{1, 2}, B{3, 4}, "x"}, `{"X": "x", "Y": 4}`},
+		{E{&A{1, 2}, 3, 0}, `{"X": 1, "Y": 2, "w": 3}`},
+		{E{nil, 3, 0}, `{"w": 3}`},
+		{map[uint]bool{1: true}, `{"1": true}`},
+		{map[bool]int{true: 1}, ``},
+		{[]uint8{1, 2}, `"AQI="`},
+		{[2]uint8{1, 2}, `[1, 2]`},
+		{(*A)(nil), `null`},
+	}
+
+	for _, test := range tests {
+		v, err := toValue(test.v)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if test.result == `` {
+			// no JSON equivalent, left as it is
+			if !reflect.DeepEqual(v, test.v) {
+				t.Errorf("%#v: expected it unchanged, got %#v", test.v, v)
+			}
+			continue
+		}
+
+		var expected interface{}
+		json.Unmarshal([]byte(test.result), &expected)
+		if !reflect.DeepEqual(expected, v) {
+			t.Errorf("%#v: expected %#v, got %#v", test.v, expected, v)
+		}
+	}
+}
+
+func TestStructTime(t *testing.T) {
+	type event struct {
+		At   time.Time  `json:"at"`
+		Done *time.Time `json:"done"`
+	}
+	at := time.Date(2014, 2, 3, 4, 5, 6, 0, time.UTC)
+	msg := event{At: at}
+
+	tests := []Test{
+		Test{exp: `.at`, result: `1391400306000`},
+		Test{exp: `.done`, result: `null`},
+		Test{exp: `$fmtTime("2006-01-02", .at)`, result: `"2014-02-03"`},
+		Test{exp: `.at == $parseTime("2006-01-02T15:04:05Z07:00", "2014-02-03T04:05:06Z")`, result: `true`},
+		Test{exp: `.at < $now()`, result: `true`},
+	}
+
+	for _, test := range tests {
+		var expected interface{}
+		json.Unmarshal([]byte(test.result), &expected)
+
+		e := MustCompile(test.exp)
+		checkSameEval(t, e, msg, nil)
+		result, err := e.Eval(msg)
+		if err != nil || !reflect.DeepEqual(expected, result) {
+			t.Errorf("%s: expected %v, got %v %v", test.exp, expected, result, err)
+		}
+	}
+
+	if _, err := MustCompile(`.at["x"]`).Eval(msg); err == nil {
+		t.Error("expected an error for a key of a time")
+	}
+}
+
+func TestStructCycle(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	n := &node{Name: "a"}
+	n.Next = n
+
+	r, err := MustCompile(`.Next.Next.Name`).Eval(n)
+	if err != nil || r != "a" {
+		t.Error("expected a, got", r, err)
+	}
+
+	_, err = MustCompile(`.Next`).Eval(n)
+	if e, ok := err.(*EvalError); !ok || e.Kind != TypeError {
+		t.Error("expected a TypeError for a cycle, got", err)
+	}
+}
+
+func benchmarkStruct(b *testing.B, marshal bool) {
+	user := testUserValue()
+	e := MustCompile(`$len(.friends[? . != null && .Age > 25].name) > 0 && .home.city == "nyc"`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var msg interface{} = user
+		if marshal {
+			data, _ := json.Marshal(user)
+			json.Unmarshal(data, &msg)
+		}
+		e.Eval(msg)
+	}
+}
+
+func BenchmarkStructMarshalEval(b *testing.B) {
+	benchmarkStruct(b, true)
+}
+
+func BenchmarkStructEval(b *testing.B) {
+	benchmarkStruct(b, false)
+}
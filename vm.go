@@ -0,0 +1,707 @@
+package jee
+
+import (
+	"reflect"
+	"sync"
+)
+
+// opcode is an instruction of the bytecode an Expression is compiled to. The
+// VM is a stack machine: instructions pop their operands off the stack and
+// push their result.
+type opcode uint8
+
+const (
+	// push consts[arg]
+	opConst opcode = iota
+	// drop the top of the stack
+	opPop
+	// push the variable in slot arg
+	opVar
+	// push the external variable named by the node
+	opExt
+	// pop the keys of the node and push the value they access in .
+	opKey
+	// pop the keys of the node and the value below them and push the value
+	// they access in it
+	opAccess
+	// push the value paths[arg] accesses in .
+	opPath
+	// replace the top of the stack with the value paths[arg] accesses in it
+	opAccessPath
+	opNeg
+	opNot
+	// pop two values and push the result of ops[arg]
+	opBinary
+	// jump to arg, leaving the left side of && or || on the stack, if it
+	// decides the result
+	opShortCircuit
+	// replace the left side of a pipe with . and make it .
+	opPipe
+	// pop the right side of a pipe, restore . and push the right side
+	opPipeEnd
+	// pop a condition and jump to arg if it is false
+	opJumpFalse
+	opJump
+	// pop a value into slot arg
+	opStore
+	// pop arg values and push them as an array
+	opArray
+	// check that the top of the stack can be used as an object key
+	opObjectKey
+	// pop arg key value pairs and push them as an object
+	opObject
+	// push lambdas[arg] as a *Lambda
+	opLambda
+	// check the top of the stack against checks[arg]
+	opCheckArg
+	// pop the arguments of the node, pass them to calls[arg] and push the
+	// result
+	opCall
+	// fail with errs[arg]
+	opFail
+)
+
+type instr struct {
+	op  opcode
+	arg int32
+	// the node the instruction was compiled from, for errors
+	t *TokenTree
+}
+
+// program is a tree compiled to bytecode. Operators and functions are
+// resolved when the program is compiled, and variables are resolved to
+// slots. Filter predicates and lambdas are compiled to code of their own
+// that shares the slots and tables of the program they appear in.
+type program struct {
+	code     []instr
+	consts   []interface{}
+	ops      []*operator
+	accesses []*access
+	paths    [][]interface{}
+	lambdas  []*lambdaCode
+	checks   []argCheck
+	calls    []funcCall
+	errs     []*EvalError
+	// the number of variable slots
+	slots int
+}
+
+// access holds the compiled filter predicates of a KEY, VAR or EXT node, by
+// accessor index
+type access struct {
+	filters [][]instr
+}
+
+// lambdaCode is a compiled TypeExpr argument
+type lambdaCode struct {
+	tree *TokenTree
+	code []instr
+	// the slot of the $x in $x -> expression, or -1
+	param int
+	// the slots of the variables of the function, by Func.Vars index
+	vars []lambdaVar
+}
+
+type lambdaVar struct {
+	slot int
+	// the slot of the variable of the same name bound outside the lambda,
+	// or -1. It is used when Call is given no value for the variable.
+	outer int
+}
+
+type argCheck struct {
+	name  string
+	i     int
+	param Type
+}
+
+type funcCall struct {
+	f    *Func
+	name string
+}
+
+// unbound is stored in the slot of a variable that is not bound. It is a
+// pointer so that it is not equal to any value of a message.
+var unbound interface{} = new(byte)
+
+// compiler compiles a tree to a program
+type compiler struct {
+	p     *program
+	funcs map[string]*Func
+	// the code being compiled
+	code []instr
+	// the names of the variables bound where the next node is compiled,
+	// by slot
+	scope []string
+}
+
+// compileProgram compiles a tree from Parser calling the functions in funcs.
+// Errors that Eval would return for a malformed tree are compiled to
+// instructions that return them.
+func compileProgram(t *TokenTree, funcs map[string]*Func) *program {
+	c := &compiler{p: &program{}, funcs: funcs}
+	c.p.code = c.sub(t)
+	return c.p
+}
+
+// sub compiles t to code of its own
+func (c *compiler) sub(t *TokenTree) []instr {
+	outer := c.code
+	c.code = nil
+	c.node(t)
+	code := c.code
+	c.code = outer
+	return code
+}
+
+func (c *compiler) emit(op opcode, arg int, t *TokenTree) int {
+	c.code = append(c.code, instr{op: op, arg: int32(arg), t: t})
+	return len(c.code) - 1
+}
+
+// patch makes the jump at i jump to the next instruction
+func (c *compiler) patch(i int) {
+	c.code[i].arg = int32(len(c.code))
+}
+
+func (c *compiler) constant(v interface{}, t *TokenTree) {
+	c.p.consts = append(c.p.consts, v)
+	c.emit(opConst, len(c.p.consts)-1, t)
+}
+
+func (c *compiler) fail(err *EvalError) {
+	c.p.errs = append(c.p.errs, err)
+	c.emit(opFail, len(c.p.errs)-1, nil)
+}
+
+func (c *compiler) bind(name string) int {
+	c.scope = append(c.scope, name)
+	if len(c.scope) > c.p.slots {
+		c.p.slots = len(c.scope)
+	}
+	return len(c.scope) - 1
+}
+
+func (c *compiler) unbind(n int) {
+	c.scope = c.scope[:len(c.scope)-n]
+}
+
+func (c *compiler) lookup(name string) int {
+	for i := len(c.scope) - 1; i >= 0; i-- {
+		if c.scope[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// node compiles t to code that leaves its value on the stack. It follows
+// eval case by case.
+func (c *compiler) node(t *TokenTree) {
+	var tokenVal string
+
+	switch t.Type {
+	case OP, KEY, FUNC, VAR, LET, EXT, LAMBDA:
+		s, ok := t.Value.(string)
+		if !ok {
+			c.fail(typeError(t, t.Value, "bad operation, key, or function: %s", t.Value))
+			return
+		}
+		tokenVal = s
+	}
+
+	switch t.Type {
+	case OP:
+		switch len(t.Tokens) {
+		case 1:
+			c.node(t.Tokens[0])
+			switch tokenVal {
+			case "-":
+				c.emit(opNeg, 0, t)
+			case "!":
+				c.emit(opNot, 0, t)
+			default:
+				c.emit(opPop, 0, t)
+				c.constant(nil, t)
+			}
+		case 2:
+			c.node(t.Tokens[0])
+			switch tokenVal {
+			case "|":
+				c.emit(opPipe, 0, t)
+				c.node(t.Tokens[1])
+				c.emit(opPipeEnd, 0, t)
+			case "&&", "||":
+				j := c.emit(opShortCircuit, 0, t)
+				c.node(t.Tokens[1])
+				c.binary(t, tokenVal)
+				c.patch(j)
+			default:
+				c.node(t.Tokens[1])
+				c.binary(t, tokenVal)
+			}
+		default:
+			c.constant(nil, t)
+		}
+	case S_STR, D_STR, CONST, RESERVED:
+		c.constant(t.Value, t)
+	case COND:
+		c.node(t.Tokens[0])
+		jumpFalse := c.emit(opJumpFalse, 0, t)
+		c.node(t.Tokens[1])
+		jump := c.emit(opJump, 0, t)
+		c.patch(jumpFalse)
+		c.node(t.Tokens[2])
+		c.patch(jump)
+	case KEY:
+		if path, ok := constantPath(t); ok {
+			c.p.paths = append(c.p.paths, path)
+			c.emit(opPath, len(c.p.paths)-1, t)
+			return
+		}
+		c.emit(opKey, c.keys(t), t)
+	case VAR:
+		slot := c.lookup(tokenVal)
+		if slot < 0 {
+			c.fail(evalError(t, UndefinedError, "undefined variable: %s", tokenVal))
+			return
+		}
+
+		c.emit(opVar, slot, t)
+		c.accessors(t)
+	case EXT:
+		c.emit(opExt, 0, t)
+		c.accessors(t)
+	case ARRAY:
+		for _, sub := range t.Tokens {
+			c.node(sub)
+		}
+		c.emit(opArray, len(t.Tokens), t)
+	case OBJECT:
+		pairs := 0
+		for i := 0; i+1 < len(t.Tokens); i += 2 {
+			c.node(t.Tokens[i])
+			c.emit(opObjectKey, 0, t.Tokens[i])
+			c.node(t.Tokens[i+1])
+			pairs++
+		}
+		c.emit(opObject, pairs, t)
+	case LET:
+		c.node(t.Tokens[0])
+		c.emit(opStore, c.bind(tokenVal), t)
+		c.node(t.Tokens[1])
+		c.unbind(1)
+	case LAMBDA:
+		c.fail(evalError(t, TypeError, "%s -> can only be used as an argument to a function that takes an expression", tokenVal))
+	case FUNC:
+		c.call(t, tokenVal)
+	default:
+		if len(t.Tokens) > 0 {
+			c.node(t.Tokens[0])
+		} else {
+			c.constant(nil, t)
+		}
+	}
+}
+
+func (c *compiler) binary(t *TokenTree, op string) {
+	c.p.ops = append(c.p.ops, lookupOperator(op))
+	c.emit(opBinary, len(c.p.ops)-1, t)
+}
+
+// accessors compiles the accessors of a VAR or EXT node, which apply to the
+// value on the top of the stack
+func (c *compiler) accessors(t *TokenTree) {
+	if len(t.Tokens) == 0 {
+		return
+	}
+	if path, ok := constantPath(t); ok {
+		c.p.paths = append(c.p.paths, path)
+		c.emit(opAccessPath, len(c.p.paths)-1, t)
+		return
+	}
+	c.emit(opAccess, c.keys(t), t)
+}
+
+// constantPath returns the keys of a KEY, VAR or EXT node if every accessor
+// is a constant string or number, like .a.b[0]. Such a path never fans out
+// and is followed by followPath.
+func constantPath(t *TokenTree) ([]interface{}, bool) {
+	path := make([]interface{}, len(t.Tokens))
+	for i, sub := range t.Tokens {
+		key := sub
+		if sub.Type == K_START && len(sub.Tokens) == 1 {
+			key = sub.Tokens[0]
+			if !isConstant(key) {
+				return nil, false
+			}
+		} else if sub.Type != KEY {
+			return nil, false
+		}
+
+		switch key.Value.(type) {
+		case string, float64:
+		default:
+			return nil, false
+		}
+		path[i] = key.Value
+	}
+	return path, true
+}
+
+// followPath is getKeyValues for a path from constantPath
+func followPath(t *TokenTree, path []interface{}, input interface{}) (interface{}, error) {
+	input = orNil(input)
+	if s, _ := t.Value.(string); len(s) > 0 && t.Type == KEY {
+		var err error
+		input, err = memberOf(t, input, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, key := range path {
+		if input == nil {
+			continue
+		}
+
+		var err error
+		switch c := key.(type) {
+		case string:
+			input, err = keyOf(t.Tokens[i], input, c)
+		case float64:
+			input, err = indexOf(t.Tokens[i], input, c)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return convertAt(t, input)
+}
+
+// keys compiles the keys of a KEY, VAR or EXT node, which are pushed in
+// order, and returns the index of its access. Accessors without a key push
+// nil.
+func (c *compiler) keys(t *TokenTree) int {
+	a := &access{filters: make([][]instr, len(t.Tokens))}
+	for i, sub := range t.Tokens {
+		switch {
+		case sub.Type == KEY:
+			c.constant(sub.Value, sub)
+		case sub.Type == K_START && len(sub.Tokens) > 0:
+			c.node(sub.Tokens[0])
+		default:
+			c.constant(nil, sub)
+			if sub.Type == FILTER && len(sub.Tokens) > 0 {
+				a.filters[i] = c.sub(sub.Tokens[0])
+			}
+		}
+	}
+
+	c.p.accesses = append(c.p.accesses, a)
+	return len(c.p.accesses) - 1
+}
+
+func (c *compiler) call(t *TokenTree, name string) {
+	f := c.funcs[name]
+	if f == nil {
+		c.fail(evalError(t, UndefinedError, "func does not exist: %s", name))
+		return
+	}
+	if !f.acceptsArgs(len(t.Tokens)) {
+		c.fail(evalError(t, ArityError, "wrong num of arguments for %s: %d", name, len(t.Tokens)))
+		return
+	}
+
+	for i, arg := range t.Tokens {
+		param := f.param(i)
+		if param == TypeExpr {
+			c.lambda(f, arg)
+			continue
+		}
+
+		c.node(arg)
+		if param != TypeAny {
+			c.p.checks = append(c.p.checks, argCheck{name: name, i: i, param: param})
+			c.emit(opCheckArg, len(c.p.checks)-1, arg)
+		}
+	}
+
+	c.p.calls = append(c.p.calls, funcCall{f: f, name: name})
+	c.emit(opCall, len(c.p.calls)-1, t)
+}
+
+// lambda compiles a TypeExpr argument. The variables of the function and
+// the $x of $x -> expression are bound to slots of their own.
+func (c *compiler) lambda(f *Func, arg *TokenTree) {
+	l := &lambdaCode{tree: arg, param: -1}
+	for _, name := range f.Vars {
+		outer := c.lookup(name)
+		l.vars = append(l.vars, lambdaVar{slot: c.bind(name), outer: outer})
+	}
+
+	bound := len(f.Vars)
+	if arg.Type == LAMBDA {
+		l.tree = arg.Tokens[0]
+		l.param = c.bind(arg.Value.(string))
+		bound++
+	}
+
+	l.code = c.sub(l.tree)
+	c.unbind(bound)
+
+	c.p.lambdas = append(c.p.lambdas, l)
+	c.emit(opLambda, len(c.p.lambdas)-1, arg)
+}
+
+// vm holds the state of one evaluation of a program
+type vm struct {
+	p     *program
+	stack []interface{}
+	vars  []interface{}
+	ext   map[string]interface{}
+	// the access whose keys are being applied
+	access *access
+}
+
+var vmPool = sync.Pool{
+	New: func() interface{} {
+		return &vm{}
+	},
+}
+
+// eval evaluates the program against msg with the external variables ext
+func (p *program) eval(msg BMsg, ext map[string]interface{}) (interface{}, error) {
+	m := vmPool.Get().(*vm)
+	m.p = p
+	m.ext = ext
+	if cap(m.vars) < p.slots {
+		m.vars = make([]interface{}, p.slots)
+	}
+	m.vars = m.vars[:p.slots]
+
+	r, err := m.run(p.code, msg)
+
+	// the stack and slots may still refer to msg, but the pool drops
+	// the vm within two garbage collections if it is not reused
+	m.stack = m.stack[:0]
+	m.p, m.ext, m.access = nil, nil, nil
+	vmPool.Put(m)
+
+	return r, err
+}
+
+// run runs code with dot as . and returns the value it leaves on the stack.
+// The stack is left as it was found, even if code fails.
+func (m *vm) run(code []instr, dot interface{}) (interface{}, error) {
+	base := len(m.stack)
+	r, err := m.exec(code, dot)
+	if err != nil {
+		m.stack = m.stack[:base]
+		return nil, err
+	}
+	return r, nil
+}
+
+func (m *vm) push(v interface{}) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *vm) pop() interface{} {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+func (m *vm) exec(code []instr, dot interface{}) (interface{}, error) {
+	p := m.p
+
+	for pc := 0; pc < len(code); pc++ {
+		in := &code[pc]
+
+		switch in.op {
+		case opConst:
+			m.push(p.consts[in.arg])
+		case opPop:
+			m.pop()
+		case opVar:
+			v := m.vars[in.arg]
+			if v == unbound {
+				return nil, evalError(in.t, UndefinedError, "undefined variable: %s", in.t.Value)
+			}
+			m.push(v)
+		case opExt:
+			v, ok := m.ext[in.t.Value.(string)]
+			if !ok {
+				return nil, evalError(in.t, UndefinedError, "undefined variable: @%s", in.t.Value)
+			}
+			if len(in.t.Tokens) == 0 {
+				// with accessors, what they reach is converted
+				var err error
+				if v, err = convertAt(in.t, v); err != nil {
+					return nil, err
+				}
+			}
+			m.push(v)
+		case opKey, opAccess:
+			// the keys are left on the stack while they are applied, the
+			// filters push above them
+			n := len(in.t.Tokens)
+			base := len(m.stack) - n
+			input := dot
+			if in.op == opAccess {
+				base--
+				input = m.stack[base]
+			}
+
+			m.access = p.accesses[in.arg]
+			v, err := getKeyValues(in.t, m.stack[len(m.stack)-n:], input, m)
+			if err != nil {
+				return nil, err
+			}
+			m.stack = m.stack[:base]
+			m.push(v)
+		case opPath:
+			v, err := followPath(in.t, p.paths[in.arg], dot)
+			if err != nil {
+				return nil, err
+			}
+			m.push(v)
+		case opAccessPath:
+			top := &m.stack[len(m.stack)-1]
+			v, err := followPath(in.t, p.paths[in.arg], *top)
+			if err != nil {
+				return nil, err
+			}
+			*top = v
+		case opNeg:
+			top := &m.stack[len(m.stack)-1]
+			if f, ok := (*top).(float64); ok {
+				*top = -1 * f
+			} else {
+				v, err := unaryOperator(in.t, "-", *top)
+				if err != nil {
+					return nil, err
+				}
+				*top = v
+			}
+		case opNot:
+			top := &m.stack[len(m.stack)-1]
+			b, ok := (*top).(bool)
+			if !ok {
+				return nil, typeError(in.t, *top, "cannot use ! operator on non-bool type")
+			}
+			*top = !b
+		case opBinary:
+			b := m.pop()
+			top := &m.stack[len(m.stack)-1]
+			r, err := applyOperator(in.t, p.ops[in.arg], *top, b)
+			if err != nil {
+				return nil, err
+			}
+			*top = r
+		case opShortCircuit:
+			decided, err := shortCircuit(in.t, in.t.Value.(string), m.stack[len(m.stack)-1])
+			if err != nil {
+				return nil, err
+			}
+			if decided {
+				pc = int(in.arg) - 1
+			}
+		case opPipe:
+			top := &m.stack[len(m.stack)-1]
+			*top, dot = dot, *top
+		case opPipeEnd:
+			r := m.pop()
+			top := &m.stack[len(m.stack)-1]
+			dot, *top = *top, r
+		case opJumpFalse:
+			c := m.pop()
+			b, ok := c.(bool)
+			if !ok {
+				return nil, typeError(in.t, c, "condition must be a bool, got: %s", reflect.TypeOf(c))
+			}
+			if !b {
+				pc = int(in.arg) - 1
+			}
+		case opJump:
+			pc = int(in.arg) - 1
+		case opStore:
+			m.vars[in.arg] = m.pop()
+		case opArray:
+			n := int(in.arg)
+			arr := make([]interface{}, n)
+			copy(arr, m.stack[len(m.stack)-n:])
+			m.stack = m.stack[:len(m.stack)-n]
+			m.push(arr)
+		case opObjectKey:
+			k := m.stack[len(m.stack)-1]
+			if _, ok := k.(string); !ok {
+				return nil, typeError(in.t, k, "object key must be a string, got: %s", reflect.TypeOf(k))
+			}
+		case opObject:
+			n := int(in.arg)
+			base := len(m.stack) - 2*n
+			obj := make(map[string]interface{}, n)
+			for i := base; i < len(m.stack); i += 2 {
+				obj[m.stack[i].(string)] = m.stack[i+1]
+			}
+			m.stack = m.stack[:base]
+			m.push(obj)
+		case opLambda:
+			l := p.lambdas[in.arg]
+			m.push(&Lambda{tree: l.tree, m: m, fn: l})
+		case opCheckArg:
+			check := p.checks[in.arg]
+			if err := checkArg(check.name, check.i, in.t, check.param, m.stack[len(m.stack)-1]); err != nil {
+				return nil, err
+			}
+		case opCall:
+			n := len(in.t.Tokens)
+			args := make([]interface{}, n)
+			copy(args, m.stack[len(m.stack)-n:])
+			m.stack = m.stack[:len(m.stack)-n]
+
+			call := p.calls[in.arg]
+			r, err := funcResult(call.f, call.name, in.t, args)
+			if err != nil {
+				return nil, err
+			}
+			m.push(r)
+		case opFail:
+			err := *p.errs[in.arg]
+			return nil, &err
+		}
+	}
+
+	return m.pop(), nil
+}
+
+// filter runs the compiled predicate of the accessor at index i of the
+// access being applied
+func (m *vm) filter(sub *TokenTree, i int, e interface{}) (interface{}, error) {
+	a := m.access
+	r, err := m.run(a.filters[i], e)
+	m.access = a
+	return r, err
+}
+
+// call runs a compiled lambda. Like (*Lambda).Call on a tree, a variable of
+// the function that is given no value is bound to whatever it is bound to
+// outside the lambda.
+func (m *vm) call(l *lambdaCode, v interface{}, values []interface{}) (interface{}, error) {
+	for i, lv := range l.vars {
+		switch {
+		case i < len(values):
+			m.vars[lv.slot] = values[i]
+		case lv.outer >= 0:
+			m.vars[lv.slot] = m.vars[lv.outer]
+		default:
+			m.vars[lv.slot] = unbound
+		}
+	}
+	if l.param >= 0 {
+		m.vars[l.param] = v
+	}
+	return m.run(l.code, v)
+}
@@ -0,0 +1,197 @@
+package jee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// treeEval evaluates an expression by walking its tree, as Eval does
+func treeEval(e *Expression, msg BMsg, vars map[string]interface{}) (interface{}, error) {
+	r, err := eval(e.tree, msg, &scope{g: &globals{vars: vars, funcs: e.funcs}})
+	if err != nil {
+		return nil, withQuery(err, e.source)
+	}
+	return r, nil
+}
+
+// checkSameEval checks that the bytecode of e evaluates to what its tree
+// evaluates to, errors included.
+func checkSameEval(t *testing.T, e *Expression, msg BMsg, vars map[string]interface{}) {
+	expected, expectedErr := treeEval(e, msg, vars)
+	result, err := e.EvalWithVars(msg, vars)
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("%s: expected error %#v, got %#v", e.tree, expectedErr, err)
+		return
+	}
+
+	// compare as Go syntax so that NaN equals NaN
+	if fmt.Sprintf("%#v", expected) != fmt.Sprintf("%#v", result) {
+		t.Errorf("%s: expected %#v, got %#v", e.tree, expected, result)
+	}
+}
+
+func TestVMSameResults(t *testing.T) {
+	var umsg BMsg
+
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+
+	vars := map[string]interface{}{"a": []interface{}{1.0, "x", nil}, "b": 1.0}
+
+	for _, exp := range allQueries() {
+		e, err := Compile(exp)
+		if err != nil {
+			// a few of the tests are expected to fail to compile
+			continue
+		}
+		checkSameEval(t, e, umsg, vars)
+	}
+}
+
+func TestVMLambdaVars(t *testing.T) {
+	twice := &Func{
+		Params: []Type{TypeAny, TypeExpr},
+		Vars:   []string{"$n"},
+		Fn: func(args []interface{}) (interface{}, error) {
+			l := args[1].(*Lambda)
+			a, err := l.Call(args[0], 1.0)
+			if err != nil {
+				return nil, err
+			}
+			// $n is not given a value, so it is bound as it is outside
+			b, err := l.Call(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{a, b}, nil
+		},
+	}
+
+	for _, test := range []Test{
+		Test{`let $n = 10 in $twice(.int, $x -> $x + $n)`, `[6, 15]`},
+		Test{`$twice(.int, $n)`, ``},
+		Test{`let $n = 10 in $twice(.int, $n -> $n)`, `[5, 5]`},
+		Test{`let $n = 2 in $twice(.int, $twice(., $x -> $x * $n))`, `[[5, 5], [5, 10]]`},
+	} {
+		e, err := Compile(test.exp, WithFunc("twice", twice))
+		if err != nil {
+			t.Fatal("failed compile", test.exp, err)
+		}
+		checkSameEval(t, e, map[string]interface{}{"int": 5.0}, nil)
+
+		r, err := e.Eval(map[string]interface{}{"int": 5.0})
+		if test.result == "" {
+			if err == nil {
+				t.Error(test.exp, "expected an error for the unbound $n, got", r)
+			}
+			continue
+		}
+
+		var expected interface{}
+		json.Unmarshal([]byte(test.result), &expected)
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("%s: expected %v, got %v (%v)", test.exp, expected, r, err)
+		}
+	}
+}
+
+// TestVMRandomTrees checks the VM against the tree walker on random trees.
+// $f calls each of its expression arguments twice, once without a value for
+// the variable it binds, and $g takes numbers only.
+func TestVMRandomTrees(t *testing.T) {
+	funcs := map[string]*Func{
+		"$f": &Func{
+			Params:   []Type{TypeAny, TypeExpr},
+			Variadic: true,
+			Vars:     []string{"$a"},
+			Fn: func(args []interface{}) (interface{}, error) {
+				out := []interface{}{args[0]}
+				for _, arg := range args[1:] {
+					l := arg.(*Lambda)
+					r, err := l.Call(args[0], 1.0)
+					if err != nil {
+						return nil, err
+					}
+					out = append(out, r)
+
+					r, err = l.Call(out)
+					if err != nil {
+						return nil, err
+					}
+					out = append(out, r)
+				}
+				return out, nil
+			},
+		},
+		"$g": &Func{
+			Params:   []Type{TypeNumber},
+			Variadic: true,
+			Fn: func(args []interface{}) (interface{}, error) {
+				sum := 0.0
+				for _, arg := range args {
+					sum += arg.(float64)
+				}
+				return sum, nil
+			},
+		},
+	}
+
+	var msg BMsg
+	json.Unmarshal([]byte(`{"a": [1, {"b1": 2}, "x", [true]], "b1": {"a": true, "_c": [0, 1]}, "_c": null, "true": 3, "if": [[1, 2], [3]]}`), &msg)
+	vars := map[string]interface{}{"a": 1, "b1": []interface{}{2.0, "b1"}, "_c": "a"}
+
+	g := &treeGen{r: rand.New(rand.NewSource(2))}
+	for i := 0; i < 20000; i++ {
+		tree := newTree(Position{}, ZERO, nil, g.expr(1+i%6))
+		e := &Expression{
+			source: tree.String(),
+			tree:   tree,
+			funcs:  funcs,
+			prog:   compileProgram(tree, funcs),
+		}
+		checkSameEval(t, e, msg, vars)
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func benchmarkExpression(b *testing.B, query string, opts ...Option) {
+	var umsg BMsg
+	testFile, _ := ioutil.ReadFile("test.json")
+	json.Unmarshal(testFile, &umsg)
+	e := MustCompile(query, opts...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Eval(umsg)
+	}
+}
+
+func BenchmarkJSONVM(b *testing.B) {
+	benchmarkExpression(b, `.['arrayObj'][2]['nested'][]['id']`)
+}
+
+func BenchmarkMathVM(b *testing.B) {
+	benchmarkExpression(b, `100 * -($sum(.arrayInt) + 5)`)
+}
+
+func BenchmarkRegexVM(b *testing.B) {
+	benchmarkExpression(b, `$regex(.string, "hello*")`)
+}
+
+func BenchmarkContainsVM(b *testing.B) {
+	benchmarkExpression(b, `$contains(.string, "hello")`)
+}
+
+func BenchmarkFoldVM(b *testing.B) {
+	benchmarkExpression(b, foldQuery)
+}
+
+func BenchmarkFoldOptimizedVM(b *testing.B) {
+	benchmarkExpression(b, foldQuery, WithOptimizer())
+}